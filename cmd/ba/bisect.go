@@ -0,0 +1,143 @@
+// Copyright 2022 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// bisectStep benchmarks commit sha1 against good and returns the tables and
+// whether a significant regression larger than threshold was found.
+func bisectStep(ctx context.Context, o *options, good *side, sha1 string, threshold float64) ([]*table, bool, error) {
+	sides := []*side{
+		{name: good.name, sha1: good.sha1, cfg: o.test},
+		{name: sha1[:12], sha1: sha1, cfg: o.test},
+	}
+	if err := measure(ctx, o, sides); err != nil {
+		return nil, false, err
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, false, err
+	}
+	t, err := o.analysis.genBenchTables(sidesStats(sides))
+	if err != nil {
+		return nil, false, err
+	}
+	// Gate on the confirmation series with -confirm, like the default mode.
+	all, gated, err := confirmTables(&o.analysis, sides, t)
+	if err != nil {
+		return nil, false, err
+	}
+	r := breaches(gated, []gateRule{{max: threshold}})
+	if len(r) == 0 {
+		fmt.Fprintf(os.Stderr, "%s is good\n", sides[1].name)
+		return all, false, nil
+	}
+	fmt.Fprintf(os.Stderr, "%s is bad:\n", sides[1].name)
+	for _, l := range r {
+		fmt.Fprintf(os.Stderr, "  %s\n", l)
+	}
+	return all, true, nil
+}
+
+// bisect returns the index of the first bad commit of n commits, oldest first,
+// where step reports whether commit i is bad. The last commit is checked
+// first, and -1 is returned if it is good, otherwise the search is pointless.
+func bisect(n int, step func(i int) (bool, error)) (int, error) {
+	bad, err := step(n - 1)
+	if err != nil || !bad {
+		return -1, err
+	}
+	// lo is good, or -1 for the known good commit; hi is bad.
+	lo, hi := -1, n-1
+	for hi-lo > 1 {
+		mid := (lo + hi) / 2
+		fmt.Fprintf(os.Stderr, "%d commits left to bisect\n", hi-lo-1)
+		if bad, err = step(mid); err != nil {
+			return -1, err
+		}
+		if bad {
+			hi = mid
+		} else {
+			lo = mid
+		}
+	}
+	return hi, nil
+}
+
+// bisectMain implements "ba bisect".
+//
+// It does a binary search over the first parent history between -good and
+// -bad. Each step benchmarks the commit against -good with the same
+// alternated measurement as the default mode.
+func bisectMain(ctx context.Context, args []string) error {
+	f := flag.NewFlagSet("bisect", flag.ExitOnError)
+	o := options{}
+	o.registerFlags(f)
+	good := f.String("good", "", "commitref known to be fast")
+	bad := f.String("bad", "HEAD", "commitref known to be slow")
+	threshold := percent(0.05)
+	f.Var(&threshold, "threshold", "significant regression above which a commit is considered bad")
+	f.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: ba bisect -good <ref> [-bad <ref>] <flags> [-- <go test flags>]\n")
+		fmt.Fprintf(os.Stderr, "\n")
+		fmt.Fprintf(os.Stderr, "ba bisect finds the first commit between -good and -bad where a benchmark\n")
+		fmt.Fprintf(os.Stderr, "regressed by more than -threshold with statistical significance.\n")
+		fmt.Fprintf(os.Stderr, "\n")
+		f.PrintDefaults()
+	}
+	if err := f.Parse(args); err != nil {
+		return err
+	}
+	if err := o.test.parse(f.Args()); err != nil {
+		return err
+	}
+	if *good == "" {
+		return errors.New("-good is required")
+	}
+	if err := o.validate(); err != nil {
+		return err
+	}
+	g := &side{name: *good}
+	var err error
+	if g.sha1, err = git("rev-parse", *good); err != nil {
+		return errors.New(g.sha1)
+	}
+	out, err := git("rev-list", "--reverse", "--first-parent", g.sha1+".."+*bad)
+	if err != nil {
+		return errors.New(out)
+	}
+	if out == "" {
+		return fmt.Errorf("%s is not a descendant of %s", *bad, *good)
+	}
+	commits := strings.Split(out, "\n")
+
+	fmt.Fprintf(os.Stderr, "bisecting %d commits\n", len(commits))
+	var t []*table
+	first, err := bisect(len(commits), func(i int) (bool, error) {
+		t2, regressed, err2 := bisectStep(ctx, &o, g, commits[i], float64(threshold))
+		if regressed {
+			t = t2
+		}
+		return regressed, err2
+	})
+	if err != nil {
+		return err
+	}
+	if first == -1 {
+		return fmt.Errorf("%s is not slower than %s by more than %s", *bad, *good, threshold)
+	}
+	subject, err := git("log", "-1", "--format=%h %s", commits[first])
+	if err != nil {
+		return errors.New(subject)
+	}
+	fmt.Printf("First bad commit: %s\n\n", subject)
+	return printBenchstat(os.Stdout, t)
+}
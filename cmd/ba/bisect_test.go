@@ -0,0 +1,56 @@
+// Copyright 2022 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestBisect(t *testing.T) {
+	data := []struct {
+		n     int
+		first int // first bad commit, n when none
+		want  int
+	}{
+		{1, 0, 0},
+		{1, 1, -1},
+		{7, 0, 0},
+		{7, 6, 6},
+		{7, 3, 3},
+		{8, 5, 5},
+		{7, 7, -1},
+	}
+	for i, l := range data {
+		var steps []int
+		got, err := bisect(l.n, func(j int) (bool, error) {
+			steps = append(steps, j)
+			return j >= l.first, nil
+		})
+		if err != nil {
+			t.Fatalf("#%d: %v", i, err)
+		}
+		if got != l.want {
+			t.Errorf("#%d: got %d, want %d (steps %v)", i, got, l.want, steps)
+		}
+		if steps[0] != l.n-1 {
+			t.Errorf("#%d: the last commit must be checked first: %v", i, steps)
+		}
+	}
+}
+
+func TestBisectError(t *testing.T) {
+	want := errors.New("interrupted")
+	calls := 0
+	_, err := bisect(7, func(j int) (bool, error) {
+		if calls++; calls == 2 {
+			return false, want
+		}
+		return true, nil
+	})
+	if err != want || calls != 2 {
+		t.Fatalf("got %v after %d steps", err, calls)
+	}
+}
@@ -0,0 +1,261 @@
+// Copyright 2022 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// testBin is a compiled test binary for one package.
+type testBin struct {
+	pkg  string // import path of the package
+	dir  string // directory of the package; the binary is run from there
+	path string // path to the compiled binary
+	// bench is the -test.bench regexp restricted to the benchmarks present on
+	// every side. It is empty to use -bench as-is.
+	bench string
+}
+
+// benchFilter returns the -test.bench regexp to use for b.
+func (b *testBin) benchFilter(bench string) string {
+	if b.bench != "" {
+		return b.bench
+	}
+	return bench
+}
+
+// testConfig is the go test flags and environment variables passed through to
+// the builds and the test binaries.
+type testConfig struct {
+	build []string // go test -c flags, e.g. "-tags", "foo"
+	run   []string // test binary flags, e.g. "-test.benchmem"
+	env   []string // environment variables, e.g. "GOEXPERIMENT=loopvar"
+}
+
+// goBuildFlags are the go test flags that are passed to go test -c. The value
+// is true when the flag takes a value.
+var goBuildFlags = map[string]bool{
+	"a":             false,
+	"asan":          false,
+	"asmflags":      true,
+	"buildmode":     true,
+	"buildvcs":      false,
+	"compiler":      true,
+	"cover":         false,
+	"covermode":     true,
+	"coverpkg":      true,
+	"gccgoflags":    true,
+	"gcflags":       true,
+	"installsuffix": true,
+	"ldflags":       true,
+	"linkshared":    false,
+	"mod":           true,
+	"modfile":       true,
+	"msan":          false,
+	"overlay":       true,
+	"p":             true,
+	"pgo":           true,
+	"race":          false,
+	"tags":          true,
+	"toolexec":      true,
+	"trimpath":      false,
+	"work":          false,
+	"x":             false,
+}
+
+// goTestBoolFlags are the test binary flags that don't take a value. The other
+// test binary flags take one.
+var goTestBoolFlags = map[string]bool{
+	"benchmem": true,
+	"failfast": true,
+	"fullpath": true,
+	"short":    true,
+	"v":        true,
+}
+
+// baTestFlags are the go test flags managed by ba itself, or only understood
+// by go test itself, which doesn't run the test binaries.
+var baTestFlags = map[string]string{
+	"C":         "run ba from the directory instead",
+	"args":      "pass the test binary flags directly",
+	"bench":     "use -bench",
+	"benchtime": "use -benchtime",
+	"c":         "the test binaries are always built",
+	"count":     "use -count",
+	"cpu":       "use -cpu",
+	"exec":      "the test binaries are run directly",
+	"json":      "use -format json",
+	"n":         "the test binaries must be built",
+	"o":         "the test binaries are built in a temporary directory",
+	"run":       "tests are not run",
+	"vet":       "go vet is not run when building the test binaries",
+}
+
+// String returns the arguments as specified.
+func (t *testConfig) String() string {
+	return strings.Join(append(append(append([]string{}, t.env...), t.build...), t.run...), " ")
+}
+
+// Set adds the space separated go test flags and environment variables, e.g.
+// "-tags foo -benchmem GOEXPERIMENT=loopvar".
+func (t *testConfig) Set(s string) error {
+	return t.parse(strings.Fields(s))
+}
+
+// parse adds go test flags and environment variables. Build flags are passed
+// to go test -c and the others to the test binaries with the "test." prefix.
+func (t *testConfig) parse(args []string) error {
+	for i := 0; i < len(args); i++ {
+		a := args[i]
+		if !strings.HasPrefix(a, "-") {
+			if k, _, ok := strings.Cut(a, "="); ok && k != "" {
+				t.env = append(t.env, a)
+				continue
+			}
+			return fmt.Errorf("unexpected argument %q; expected go test flags or environment variables", a)
+		}
+		name, value, hasValue := strings.Cut(strings.TrimLeft(a, "-"), "=")
+		name = strings.TrimPrefix(name, "test.")
+		if why := baTestFlags[name]; why != "" {
+			return fmt.Errorf("can't pass -%s to go test: %s", name, why)
+		}
+		takesValue, isBuild := goBuildFlags[name]
+		if !isBuild {
+			takesValue = !goTestBoolFlags[name]
+		}
+		flags := []string{"-" + name}
+		if isBuild {
+			flags[0] = a
+		} else if hasValue {
+			flags[0] = "-test." + name + "=" + value
+		} else {
+			flags[0] = "-test." + name
+		}
+		if takesValue && !hasValue {
+			if i+1 == len(args) {
+				return fmt.Errorf("missing value for %s", a)
+			}
+			i++
+			flags = append(flags, args[i])
+		}
+		if isBuild {
+			t.build = append(t.build, flags...)
+		} else {
+			t.run = append(t.run, flags...)
+		}
+	}
+	return nil
+}
+
+// isEmpty returns true if nothing is passed through.
+func (t *testConfig) isEmpty() bool {
+	return len(t.build) == 0 && len(t.run) == 0 && len(t.env) == 0
+}
+
+// with returns the concatenation of t and o.
+func (t *testConfig) with(o *testConfig) testConfig {
+	return testConfig{
+		build: append(append([]string{}, t.build...), o.build...),
+		run:   append(append([]string{}, t.run...), o.run...),
+		env:   append(append([]string{}, t.env...), o.env...),
+	}
+}
+
+// command returns a command running in dir with the environment variables of
+// t.
+func (t *testConfig) command(ctx context.Context, dir, name string, args ...string) *exec.Cmd {
+	/* #nosec G204 */
+	c := exec.CommandContext(ctx, name, args...)
+	c.Dir = dir
+	if len(t.env) != 0 {
+		c.Env = append(os.Environ(), t.env...)
+	}
+	return c
+}
+
+// listTestPkgs returns the packages matching pkg that have tests, as seen from
+// dir with the build flags of cfg.
+func listTestPkgs(ctx context.Context, dir, pkg string, cfg *testConfig) ([]*testBin, error) {
+	// -e so a package that doesn't compile is listed instead of failing.
+	args := append(append([]string{"list", "-e", "-json"}, cfg.build...), pkg)
+	c := cfg.command(ctx, dir, "go", args...)
+	stderr := bytes.Buffer{}
+	c.Stderr = &stderr
+	out, err := c.Output()
+	if err != nil {
+		return nil, fmt.Errorf("go list %s: %s", pkg, strings.TrimSpace(stderr.String()))
+	}
+	var bins []*testBin
+	for d := json.NewDecoder(bytes.NewReader(out)); ; {
+		p := struct {
+			ImportPath   string
+			Dir          string
+			TestGoFiles  []string
+			XTestGoFiles []string
+		}{}
+		if err = d.Decode(&p); err != nil {
+			if errors.Is(err, io.EOF) {
+				break
+			}
+			return nil, err
+		}
+		if len(p.TestGoFiles) != 0 || len(p.XTestGoFiles) != 0 {
+			bins = append(bins, &testBin{pkg: p.ImportPath, dir: p.Dir})
+		}
+	}
+	return bins, nil
+}
+
+// buildTestBins compiles once the test binary of every package matching pkg
+// that has tests, as seen from s.dir. The binaries are written in dst.
+//
+// The packages that fail to build are skipped and recorded in s.broken.
+func buildTestBins(ctx context.Context, s *side, pkg, dst string) error {
+	bins, err := listTestPkgs(ctx, s.dir, pkg, &s.cfg)
+	if err != nil {
+		return err
+	}
+	if err = os.MkdirAll(dst, 0o700); err != nil {
+		return err
+	}
+	var built []*testBin
+	for _, b := range bins {
+		b.path = filepath.Join(dst, strings.ReplaceAll(b.pkg, "/", "_")+".test")
+		args := append(append([]string{"test", "-c", "-o", b.path}, s.cfg.build...), b.pkg)
+		line := append(append([]string{}, s.cfg.env...), "go", "test", "-c")
+		line = append(append(line, s.cfg.build...), b.pkg)
+		fmt.Fprintf(os.Stderr, "%s: %s\n", s.name, strings.Join(line, " "))
+		c := s.cfg.command(ctx, s.dir, "go", args...)
+		out, err2 := c.CombinedOutput()
+		if err2 != nil {
+			// Tolerate it, e.g. a new benchmark may use an API that doesn't exist
+			// on the base commit. See commonBenchmarks.
+			fmt.Fprintf(os.Stderr, "%s: failed to build %s: %s\n%s", s.name, b.pkg, err2, out)
+			if s.broken == nil {
+				s.broken = map[string]string{}
+			}
+			s.broken[b.pkg] = string(out)
+			continue
+		}
+		built = append(built, b)
+	}
+	c := s.cfg.command(ctx, s.dir, "go", "tool", "-n", "test2json")
+	out, err := c.Output()
+	if err != nil {
+		return fmt.Errorf("%s: failed to find test2json: %w", s.name, err)
+	}
+	s.test2json = strings.TrimSpace(string(out))
+	s.bins = built
+	return nil
+}
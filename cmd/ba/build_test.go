@@ -0,0 +1,54 @@
+// Copyright 2022 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"reflect"
+	"testing"
+)
+
+func TestListTestPkgs(t *testing.T) {
+	bins, err := listTestPkgs(context.Background(), ".", ".", &testConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(bins) != 1 || bins[0].pkg != "github.com/maruel/pat/cmd/ba" || bins[0].dir == "" {
+		t.Fatalf("%#v", bins)
+	}
+}
+
+func TestTestConfig(t *testing.T) {
+	c := testConfig{}
+	args := []string{"-tags", "purego", "-gcflags=-N", "-race", "-x", "-benchmem", "-timeout", "10m", "-test.short", "-shuffle=on", "GOEXPERIMENT=loopvar"}
+	if err := c.parse(args); err != nil {
+		t.Fatal(err)
+	}
+	want := testConfig{
+		build: []string{"-tags", "purego", "-gcflags=-N", "-race", "-x"},
+		run:   []string{"-test.benchmem", "-test.timeout", "10m", "-test.short", "-test.shuffle=on"},
+		env:   []string{"GOEXPERIMENT=loopvar"},
+	}
+	if !reflect.DeepEqual(c, want) {
+		t.Fatalf("got %#v, want %#v", c, want)
+	}
+	if s := c.String(); s != "GOEXPERIMENT=loopvar -tags purego -gcflags=-N -race -x -test.benchmem -test.timeout 10m -test.short -test.shuffle=on" {
+		t.Fatal(s)
+	}
+	extra := testConfig{}
+	if err := extra.Set("-tags other GODEBUG=x=1"); err != nil {
+		t.Fatal(err)
+	}
+	got := c.with(&extra)
+	if len(got.build) != 7 || got.env[1] != "GODEBUG=x=1" || len(c.build) != 5 {
+		t.Fatalf("%#v", got)
+	}
+	for _, in := range []string{"-bench=.", "-test.count 3", "-tags", "foo", "-o x", "-vet=off", "-exec echo", "-n", "-args -foo", "-C dir"} {
+		c := testConfig{}
+		if err := c.Set(in); err == nil {
+			t.Errorf("%q: expected error", in)
+		}
+	}
+}
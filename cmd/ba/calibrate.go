@@ -0,0 +1,174 @@
+// Copyright 2022 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/perf/benchfmt"
+)
+
+// job is one benchmark scheduled individually after calibration.
+type job struct {
+	pkg   string  // import path of the package
+	name  string  // full benchmark name without the "Benchmark" prefix and GOMAXPROCS suffix
+	cpu   int     // GOMAXPROCS, passed as -test.cpu
+	cost  float64 // seconds per iteration, as measured during calibration
+	iters int     // iterations per sample, passed as -test.benchtime Nx
+	count int     // samples per series, passed as -test.count
+}
+
+// benchRegexp returns a -test.bench regexp matching exactly the benchmark
+// name, including its sub-benchmarks parts.
+func benchRegexp(name string) string {
+	parts := strings.Split("Benchmark"+name, "/")
+	for i := range parts {
+		parts[i] = "^" + regexp.QuoteMeta(parts[i]) + "$"
+	}
+	return strings.Join(parts, "/")
+}
+
+// fullName returns the benchmark name as printed by the testing package.
+func (j *job) fullName() string {
+	if j.cpu == 1 {
+		return j.name
+	}
+	return j.name + "-" + strconv.Itoa(j.cpu)
+}
+
+// splitProcs splits the "-N" GOMAXPROCS suffix from a benchmark name. The
+// testing package omits it when GOMAXPROCS is 1.
+func splitProcs(name benchfmt.Name) (string, int) {
+	if _, parts := name.Parts(); len(parts) != 0 {
+		last := parts[len(parts)-1]
+		if last[0] == '-' {
+			if cpu, err := strconv.Atoi(string(last[1:])); err == nil {
+				return string(name[:len(name)-len(last)]), cpu
+			}
+		}
+	}
+	return name.String(), 1
+}
+
+// calibrate runs every benchmark matching bench briefly on each side and
+// returns one job per benchmark and GOMAXPROCS value in cpu with the cost of
+// one iteration. The highest cost across sides is kept.
+//
+// A short benchtime is used instead of 1x so the cost of very fast benchmarks
+// is not dominated by the timer overhead, while benchmarks slower than
+// benchtime are still run exactly once.
+func calibrate(ctx context.Context, sides []*side, bench, cpu string, benchtime time.Duration) ([]*job, error) {
+	fmt.Fprintf(os.Stderr, "calibrating\n")
+	args := []string{
+		"-test.benchtime", benchtime.String(),
+		"-test.count", "1",
+		"-test.run", "^$",
+		"-test.cpu", cpu,
+	}
+	var jobs []*job
+	m := map[string]*job{}
+	for _, s := range sides {
+		for _, b := range s.bins {
+			out, err := runBin(ctx, s, b, append([]string{"-test.bench", b.benchFilter(bench)}, args...))
+			if err != nil {
+				return nil, err
+			}
+			r := benchfmt.NewReader(strings.NewReader(out), b.pkg)
+			for r.Scan() {
+				res, ok := r.Result().(*benchfmt.Result)
+				if !ok {
+					continue
+				}
+				cost, ok := res.Value("sec/op")
+				if !ok {
+					continue
+				}
+				key := b.pkg + "\x00" + res.Name.String()
+				j := m[key]
+				if j == nil {
+					j = &job{pkg: b.pkg}
+					j.name, j.cpu = splitProcs(res.Name)
+					m[key] = j
+					jobs = append(jobs, j)
+				}
+				if cost > j.cost {
+					j.cost = cost
+				}
+			}
+			if err = r.Err(); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return jobs, nil
+}
+
+// schedule assigns iterations and sample count to each job.
+//
+// Each sample lasts about benchtime, or a single iteration for benchmarks
+// slower than that. The budget is split evenly across all the benchmarks on
+// all the sides for all the series, so each benchmark gets a similar number of
+// samples, at least one per series.
+func schedule(jobs []*job, benchtime, budget time.Duration, series, sides int) {
+	if len(jobs) == 0 {
+		return
+	}
+	slot := budget.Seconds() / float64(len(jobs)*series*sides)
+	for _, j := range jobs {
+		cost := j.cost
+		if cost <= 0 {
+			cost = 1e-9
+		}
+		j.iters = int(benchtime.Seconds() / cost)
+		if j.iters < 1 {
+			j.iters = 1
+		}
+		j.count = int(slot / (float64(j.iters) * cost))
+		if j.count < 1 {
+			j.count = 1
+		}
+	}
+}
+
+// runJobs runs each job individually with the precompiled test binaries of s
+// and returns the concatenated output.
+//
+// The jobs that were not calibrated run for benchtime, count times.
+func runJobs(ctx context.Context, s *side, jobs []*job, benchtime time.Duration, count int) (string, error) {
+	bins := make(map[string]*testBin, len(s.bins))
+	for _, b := range s.bins {
+		bins[b.pkg] = b
+	}
+	out := ""
+	for _, j := range jobs {
+		b := bins[j.pkg]
+		if b == nil {
+			return out, fmt.Errorf("%s: package %s not found", s.name, j.pkg)
+		}
+		bt, c := benchtime.String(), count
+		if j.iters != 0 {
+			bt, c = strconv.Itoa(j.iters)+"x", j.count
+		}
+		args := []string{
+			"-test.bench", benchRegexp(j.name),
+			"-test.benchtime", bt,
+			"-test.count", strconv.Itoa(c),
+			"-test.run", "^$",
+			"-test.cpu", strconv.Itoa(j.cpu),
+		}
+		o, err := runBin(ctx, s, b, args)
+		out += o
+		if err != nil {
+			return out, err
+		}
+	}
+	return out, nil
+}
@@ -0,0 +1,71 @@
+// Copyright 2022 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"testing"
+	"time"
+
+	"golang.org/x/perf/benchfmt"
+)
+
+func TestBenchRegexp(t *testing.T) {
+	data := []struct {
+		in   string
+		want string
+	}{
+		{"Foo", "^BenchmarkFoo$"},
+		{"Foo/bar=1", "^BenchmarkFoo$/^bar=1$"},
+		{"Foo/a.b(c)", "^BenchmarkFoo$/^a\\.b\\(c\\)$"},
+	}
+	for i, l := range data {
+		if got := benchRegexp(l.in); got != l.want {
+			t.Errorf("#%d: got %q, want %q", i, got, l.want)
+		}
+	}
+}
+
+func TestSplitProcs(t *testing.T) {
+	data := []struct {
+		in   string
+		name string
+		cpu  int
+	}{
+		{"Foo", "Foo", 1},
+		{"Foo-8", "Foo", 8},
+		{"Foo/size=4k-16", "Foo/size=4k", 16},
+		{"Foo/a-b", "Foo/a-b", 1},
+	}
+	for i, l := range data {
+		name, cpu := splitProcs(benchfmt.Name(l.in))
+		if name != l.name || cpu != l.cpu {
+			t.Errorf("#%d: got %q %d, want %q %d", i, name, cpu, l.name, l.cpu)
+		}
+		j := job{name: name, cpu: cpu}
+		if s := j.fullName(); s != l.in {
+			t.Errorf("#%d: got %q", i, s)
+		}
+	}
+}
+
+func TestSchedule(t *testing.T) {
+	jobs := []*job{
+		{name: "Fast", cost: 2e-9},
+		{name: "Normal", cost: 1e-3},
+		{name: "Slow", cost: 2},
+	}
+	// 30s split across 3 jobs, 2 sides and 1 series gives a 5s slot each.
+	schedule(jobs, 100*time.Millisecond, 30*time.Second, 1, 2)
+	want := []struct{ iters, count int }{
+		{50000000, 50},
+		{100, 50},
+		{1, 2},
+	}
+	for i, j := range jobs {
+		if j.iters != want[i].iters || j.count != want[i].count {
+			t.Errorf("%s: got %d x %d, want %d x %d", j.name, j.count, j.iters, want[i].count, want[i].iters)
+		}
+	}
+}
@@ -0,0 +1,116 @@
+// Copyright 2022 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"os"
+	"strings"
+	"time"
+)
+
+// isChanged returns true if the row has a significant change.
+func isChanged(r *row) bool {
+	return r.change != 0
+}
+
+// confirmCount returns the samples to take per confirmation series so the
+// confirmation series together take at least as many samples as the screening
+// series, count per series, otherwise a change could never be significant
+// with few confirmation series.
+func confirmCount(count, screening, confirm int) int {
+	return (count*screening + confirm - 1) / confirm
+}
+
+// confirm re-runs only the benchmarks with a significant change in the
+// screening series, each one individually and in alternation like the
+// screening series, for o.confirm series. The output is accumulated in each
+// side's confirmRuns.
+//
+// calibrated are the jobs from the calibration with -calibrate, so the
+// benchmarks keep their iterations.
+func confirm(ctx context.Context, o *options, sides, order []*side, calibrated []*job, rng *rand.Rand) error {
+	t, err := o.analysis.genBenchTables(sidesStats(sides))
+	if err != nil {
+		return err
+	}
+	jobs := calibrated
+	if !o.calibrate {
+		if jobs, err = benchmarks(strings.Join(sides[len(sides)-1].runs, "")); err != nil {
+			return err
+		}
+	}
+	if jobs = selectJobs(jobs, t, isChanged); len(jobs) == 0 {
+		fmt.Fprintf(os.Stderr, "no significant change to confirm\n")
+		return nil
+	}
+	screening := len(sides[0].runs)
+	count := confirmCount(o.count, screening, o.confirm)
+	if o.calibrate {
+		// Copy so the calibrated jobs are left as-is.
+		c := make([]*job, len(jobs))
+		for i, j := range jobs {
+			j2 := *j
+			j2.count = confirmCount(j.count, screening, o.confirm)
+			c[i] = &j2
+		}
+		jobs = c
+	}
+	fmt.Fprintf(os.Stderr, "confirming %d benchmarks with %d series\n", len(jobs), o.confirm)
+	start := time.Now()
+	for i := 0; i < o.confirm; i++ {
+		for j, s := range seriesOrder(o.order, i, order, rng) {
+			if err = ctx.Err(); err != nil {
+				// Don't error out, report the screening results.
+				return nil
+			}
+			s.status.set(fmt.Sprintf("confirmation %d/%d", i+1, o.confirm), eta(start, i*len(order)+j, o.confirm*len(order)))
+			out := ""
+			err = o.isolation.run(func() error {
+				var err2 error
+				out, err2 = runJobs(ctx, s, shuffleJobs(o.order, jobs, rng), o.benchtime, count)
+				return err2
+			})
+			if err != nil {
+				return err
+			}
+			s.confirmRuns = append(s.confirmRuns, out)
+		}
+	}
+	return nil
+}
+
+// confirmTables returns the tables of the screening series followed by the
+// tables of the confirmation series, if any, with a "phase" configuration to
+// tell them apart, and the tables to gate on: the confirmation ones if any.
+func confirmTables(a *analysis, sides []*side, screening []*table) ([]*table, []*table, error) {
+	names := make([]string, len(sides))
+	outs := make([]string, len(sides))
+	for i, s := range sides {
+		names[i] = s.name
+		outs[i] = strings.Join(s.confirmRuns, "")
+	}
+	if strings.Join(outs, "") == "" {
+		return screening, screening, nil
+	}
+	confirmed, err := a.genBenchTables(names, outs)
+	if err != nil {
+		return nil, nil, err
+	}
+	all := make([]*table, 0, len(screening)+len(confirmed))
+	for _, t := range screening {
+		// Copy so the screening tables are left as-is.
+		c := *t
+		c.config = append(append([]configValue{}, t.config...), configValue{key: "phase", value: "screening"})
+		all = append(all, &c)
+	}
+	for _, t := range confirmed {
+		t.config = append(t.config, configValue{key: "phase", value: "confirmation"})
+		all = append(all, t)
+	}
+	return all, confirmed, nil
+}
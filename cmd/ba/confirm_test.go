@@ -0,0 +1,62 @@
+// Copyright 2022 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import "testing"
+
+func TestConfirmTables(t *testing.T) {
+	a := newAnalysis()
+	sides := []*side{
+		{name: "HEAD~1", runs: []string{testOld}},
+		{name: "HEAD", runs: []string{testNew}},
+	}
+	screening := getTestTables(t)
+	all, gated, err := confirmTables(&a, sides, screening)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(all) != 1 || len(gated) != 1 || all[0] != screening[0] {
+		t.Fatal("without confirmation series, the screening tables are used as-is")
+	}
+
+	// Foo regressed in screening but not in confirmation.
+	sides[0].confirmRuns = []string{testOld}
+	sides[1].confirmRuns = []string{testOld}
+	if all, gated, err = confirmTables(&a, sides, screening); err != nil {
+		t.Fatal(err)
+	}
+	if len(all) != 2 || len(gated) != 1 || gated[0] != all[1] {
+		t.Fatalf("unexpected %d %d", len(all), len(gated))
+	}
+	if c := all[0].config; len(c) != 1 || c[0].value != "screening" || len(screening[0].config) != 0 {
+		t.Fatalf("unexpected %v", c)
+	}
+	if c := all[1].config; len(c) != 1 || c[0].value != "confirmation" {
+		t.Fatalf("unexpected %v", c)
+	}
+	if b := breaches(gated, []gateRule{{max: 0.05}}); len(b) != 0 {
+		t.Fatalf("unexpected %q", b)
+	}
+	if b := breaches(all[:1], []gateRule{{max: 0.05}}); len(b) != 1 {
+		t.Fatalf("unexpected %q", b)
+	}
+}
+
+func TestConfirmCount(t *testing.T) {
+	data := []struct {
+		count, screening, confirm, want int
+	}{
+		{2, 3, 1, 6},
+		{2, 3, 2, 3},
+		{2, 3, 4, 2},
+		{2, 3, 6, 1},
+		{2, 3, 10, 1},
+	}
+	for i, l := range data {
+		if got := confirmCount(l.count, l.screening, l.confirm); got != l.want {
+			t.Errorf("#%d: got %d, want %d", i, got, l.want)
+		}
+	}
+}
@@ -0,0 +1,376 @@
+// Copyright 2022 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"html/template"
+	"io"
+	"strings"
+	"unicode/utf8"
+
+	"golang.org/x/perf/benchunit"
+)
+
+// outputFormats are the supported -format values.
+var outputFormats = []string{"text", "json", "markdown", "html", "github"}
+
+const formatHelp = "format to print; one of text, json, markdown, html or github"
+
+func isOutputFormat(format string) bool {
+	for _, f := range outputFormats {
+		if f == format {
+			return true
+		}
+	}
+	return false
+}
+
+// printTables writes the tables to w in the specified format.
+//
+// m may be nil when unknown. It is included in the json format, and its
+// benchmarks not compared are listed after the tables in the other formats.
+// rules are only used by the github format, to annotate the regressions that
+// breach them as errors.
+func printTables(w io.Writer, format string, m *runMetadata, tables []*table, rules []gateRule) error {
+	var unmatched []benchDiff
+	if m != nil {
+		unmatched = m.Unmatched
+	}
+	switch format {
+	case "text":
+		if err := printBenchstat(w, tables); err != nil {
+			return err
+		}
+		return printUnmatched(w, unmatched)
+	case "json":
+		return jsonBenchstat(w, m, tables)
+	case "markdown":
+		if err := markdownBenchstat(w, tables); err != nil {
+			return err
+		}
+		return markdownUnmatched(w, unmatched)
+	case "html":
+		return htmlBenchstat(w, tables, unmatched)
+	case "github":
+		return githubBenchstat(w, tables, unmatched, rules)
+	default:
+		return errors.New("internal error")
+	}
+}
+
+// configHeader returns the configuration of t that differs from the
+// previous table prev, or all of it if prev is nil.
+func configHeader(t, prev *table) []configValue {
+	var out []configValue
+	for i, c := range t.config {
+		if prev == nil || i >= len(prev.config) || prev.config[i] != c {
+			out = append(out, c)
+		}
+	}
+	return out
+}
+
+// rowScaler returns a common scaler for the values of the row.
+func rowScaler(t *table, r *row) benchunit.Scaler {
+	var values []float64
+	for _, c := range r.cells {
+		if c != nil {
+			values = append(values, c.summary.Center)
+		}
+	}
+	return benchunit.CommonScale(values, benchunit.ClassOf(t.metric))
+}
+
+// formatCell returns the center of c and its confidence interval.
+func formatCell(s benchunit.Scaler, c *cell) (string, string) {
+	if len(c.values) == 0 {
+		// The geometric mean has no confidence interval.
+		return s.Format(c.summary.Center), ""
+	}
+	return s.Format(c.summary.Center), "± " + c.summary.PctRangeString()
+}
+
+// textColumn is the layout of a column in a text table.
+type textColumn struct {
+	margin string // printed before the column, except the first one
+	right  bool   // right aligned
+}
+
+// writeText writes lines of cells aligned in columns.
+func writeText(w io.Writer, cols []textColumn, lines [][]string) error {
+	widths := make([]int, len(cols))
+	for _, l := range lines {
+		for i, c := range l {
+			if n := utf8.RuneCountInString(c); n > widths[i] {
+				widths[i] = n
+			}
+		}
+	}
+	for _, l := range lines {
+		b := strings.Builder{}
+		for i, c := range l {
+			if i != 0 {
+				b.WriteString(cols[i].margin)
+			}
+			pad := strings.Repeat(" ", widths[i]-utf8.RuneCountInString(c))
+			if cols[i].right {
+				b.WriteString(pad + c)
+			} else {
+				b.WriteString(c + pad)
+			}
+		}
+		if _, err := fmt.Fprintf(w, "%s\n", strings.TrimRight(b.String(), " ")); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// printBenchstat writes the tables as text, in a layout similar to the
+// benchstat command.
+//
+// Each column shows the center of the samples, the median unless -delta-test
+// ttest is used, with its 95% confidence interval. Each column after the
+// first one is compared against the first one.
+func printBenchstat(w io.Writer, tables []*table) error {
+	var prev *table
+	for i, t := range tables {
+		if i > 0 {
+			if _, err := fmt.Fprintf(w, "\n"); err != nil {
+				return err
+			}
+		}
+		for _, c := range configHeader(t, prev) {
+			if _, err := fmt.Fprintf(w, "%s: %s\n", c.key, c.value); err != nil {
+				return err
+			}
+		}
+		prev = t
+		cols := []textColumn{{}}
+		names := []string{""}
+		units := []string{""}
+		for j, c := range t.configs {
+			cols = append(cols, textColumn{margin: "   ", right: true}, textColumn{margin: " "})
+			names = append(names, c, "")
+			units = append(units, t.metric, "")
+			if j > 0 {
+				cols = append(cols, textColumn{margin: "  ", right: true}, textColumn{margin: " "})
+				names = append(names, "", "")
+				units = append(units, "vs base", "")
+			}
+		}
+		lines := [][]string{names, units}
+		for _, r := range t.rows {
+			s := rowScaler(t, r)
+			l := []string{r.benchmark}
+			for j, c := range r.cells {
+				if c == nil {
+					l = append(l, "", "")
+				} else {
+					v, ci := formatCell(s, c)
+					l = append(l, v, ci)
+				}
+				if j > 0 {
+					if c == nil {
+						l = append(l, "", "")
+					} else {
+						l = append(l, c.delta, c.note)
+					}
+				}
+			}
+			lines = append(lines, l)
+		}
+		if err := writeText(w, cols, lines); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// markdownEscaper escapes the characters that would break a Markdown table.
+var markdownEscaper = strings.NewReplacer("|", "\\|", "*", "\\*", "_", "\\_")
+
+// markdownBenchstat writes the tables as GitHub flavored Markdown tables.
+//
+// Significant improvements and regressions are marked with a green and a red
+// circle respectively, since Markdown doesn't support colors.
+func markdownBenchstat(w io.Writer, tables []*table) error {
+	var prev *table
+	for i, t := range tables {
+		if i > 0 {
+			if _, err := fmt.Fprintf(w, "\n"); err != nil {
+				return err
+			}
+		}
+		if c := configHeader(t, prev); len(c) != 0 {
+			l := make([]string, len(c))
+			for j := range c {
+				l[j] = markdownEscaper.Replace(c[j].key + ": " + c[j].value)
+			}
+			if _, err := fmt.Fprintf(w, "%s\n\n", strings.Join(l, ", ")); err != nil {
+				return err
+			}
+		}
+		prev = t
+		hdr := []string{markdownEscaper.Replace(t.metric)}
+		align := []string{":--"}
+		for j, c := range t.configs {
+			hdr = append(hdr, markdownEscaper.Replace(c))
+			align = append(align, "--:")
+			if j > 0 {
+				hdr = append(hdr, "vs base")
+				align = append(align, "--:")
+			}
+		}
+		if _, err := fmt.Fprintf(w, "| %s |\n| %s |\n", strings.Join(hdr, " | "), strings.Join(align, " | ")); err != nil {
+			return err
+		}
+		for _, r := range t.rows {
+			s := rowScaler(t, r)
+			cols := []string{markdownEscaper.Replace(r.benchmark)}
+			for j, c := range r.cells {
+				if c == nil {
+					cols = append(cols, "")
+				} else {
+					v, ci := formatCell(s, c)
+					cols = append(cols, strings.TrimSpace(v+" "+ci))
+				}
+				if j > 0 {
+					delta := ""
+					if c != nil {
+						delta = c.delta
+						if c.change > 0 {
+							delta = "🟢 " + delta
+						} else if c.change < 0 {
+							delta = "🔴 " + delta
+						}
+						delta = strings.TrimSpace(delta + " " + c.note)
+					}
+					cols = append(cols, delta)
+				}
+			}
+			if _, err := fmt.Fprintf(w, "| %s |\n", strings.Join(cols, " | ")); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// htmlHeader is the beginning of the HTML document, with the style to color
+// the tables.
+const htmlHeader = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>ba</title>
+<style>
+table.benchstat { border-collapse: collapse; font-family: monospace; margin-bottom: 1em; }
+table.benchstat caption { text-align: left; }
+table.benchstat th, table.benchstat td { padding: 0.1em 0.5em; text-align: right; }
+table.benchstat td:first-child, table.benchstat td.note { text-align: left; }
+table.benchstat td.better { color: #080; font-weight: bold; }
+table.benchstat td.worse { color: #c00; font-weight: bold; }
+table.benchstat td.note { color: #888; }
+</style>
+</head>
+<body>
+`
+
+const htmlFooter = `</body>
+</html>
+`
+
+// htmlTables renders the tables. It is executed on htmlTable items.
+var htmlTables = template.Must(template.New("").Parse(`{{range .}}<table class='benchstat'>
+{{with .Config}}<caption>{{.}}</caption>
+{{end}}<tr><th>{{.Metric}}</th>{{range $i, $c := .Configs}}<th>{{$c}}</th>{{if $i}}<th colspan='2'>vs base</th>{{end}}{{end}}</tr>
+{{range .Rows}}<tr class='{{.Class}}'><td>{{.Name}}</td>{{range $i, $c := .Cells}}<td>{{$c.Value}}</td>{{if $i}}<td class='delta {{$c.Class}}'>{{$c.Delta}}</td><td class='note'>{{$c.Note}}</td>{{end}}{{end}}</tr>
+{{end}}</table>
+{{end}}`))
+
+// htmlUnmatched renders the benchmarks not compared.
+var htmlUnmatched = template.Must(template.New("").Parse(`{{if .}}<h3>Not compared</h3>
+<ul>
+{{range .}}<li>{{.String}}</li>
+{{end}}</ul>
+{{end}}`))
+
+type htmlTable struct {
+	Config  string
+	Metric  string
+	Configs []string
+	Rows    []htmlRow
+}
+
+type htmlRow struct {
+	Class string // class of the last column compared to the first one
+	Name  string
+	Cells []htmlCell
+}
+
+type htmlCell struct {
+	Value string
+	Delta string
+	Note  string
+	Class string
+}
+
+// changeClass returns the CSS class for a change.
+func changeClass(change int) string {
+	switch {
+	case change > 0:
+		return "better"
+	case change < 0:
+		return "worse"
+	default:
+		return "unchanged"
+	}
+}
+
+// htmlBenchstat writes the tables as a standalone HTML document, with
+// significant improvements in green and regressions in red, followed by the
+// benchmarks not compared.
+func htmlBenchstat(w io.Writer, tables []*table, unmatched []benchDiff) error {
+	var data []htmlTable
+	var prev *table
+	for _, t := range tables {
+		ht := htmlTable{Metric: t.metric, Configs: t.configs}
+		var c []string
+		for _, v := range configHeader(t, prev) {
+			c = append(c, v.key+": "+v.value)
+		}
+		ht.Config = strings.Join(c, ", ")
+		prev = t
+		for _, r := range t.rows {
+			s := rowScaler(t, r)
+			hr := htmlRow{Class: changeClass(r.change), Name: r.benchmark}
+			for _, c := range r.cells {
+				hc := htmlCell{}
+				if c != nil {
+					v, ci := formatCell(s, c)
+					hc = htmlCell{Value: strings.TrimSpace(v + " " + ci), Delta: c.delta, Note: c.note, Class: changeClass(c.change)}
+				}
+				hr.Cells = append(hr.Cells, hc)
+			}
+			ht.Rows = append(ht.Rows, hr)
+		}
+		data = append(data, ht)
+	}
+	buf := bytes.Buffer{}
+	buf.WriteString(htmlHeader)
+	if err := htmlTables.Execute(&buf, data); err != nil {
+		return err
+	}
+	if err := htmlUnmatched.Execute(&buf, unmatched); err != nil {
+		return err
+	}
+	buf.WriteString(htmlFooter)
+	_, err := buf.WriteTo(w)
+	return err
+}
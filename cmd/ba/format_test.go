@@ -0,0 +1,24 @@
+// Copyright 2022 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestHTMLBenchstat(t *testing.T) {
+	buf := bytes.Buffer{}
+	if err := htmlBenchstat(&buf, getTestTables(t), nil); err != nil {
+		t.Fatal(err)
+	}
+	got := buf.String()
+	for _, want := range []string{"<!DOCTYPE html>", "<tr class='worse'><td>Foo</td>", "<tr class='better'><td>Bar</td>", "</html>\n"} {
+		if !strings.Contains(got, want) {
+			t.Fatalf("missing %q in:\n%s", want, got)
+		}
+	}
+}
@@ -0,0 +1,154 @@
+// Copyright 2022 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"regexp"
+	"strings"
+
+	"golang.org/x/perf/benchunit"
+)
+
+// gateRule is the maximum regression allowed for a metric and benchmarks.
+type gateRule struct {
+	metric string         // tidied unit, e.g. "sec/op"; empty for all
+	re     *regexp.Regexp // benchmarks to apply to; nil for all
+	max    float64        // maximum regression ratio, e.g. 0.05; +Inf when off
+}
+
+func (r *gateRule) match(metric, benchmark string) bool {
+	return (r.metric == "" || r.metric == metric) && (r.re == nil || r.re.MatchString(benchmark))
+}
+
+func (r *gateRule) String() string {
+	s := r.metric
+	if r.re != nil {
+		s += "@" + r.re.String()
+	}
+	v := percent(r.max).String()
+	if math.IsInf(r.max, 1) {
+		v = "off"
+	}
+	if s == "" {
+		return v
+	}
+	return s + "=" + v
+}
+
+const maxRegressionHelp = "exit with an error on significant regressions above this; comma separated list of [<metric>][@<regexp>]=<percent>|off, e.g. 5%,B/op=0%,sec/op@^Hot=2%,p99-ns=off; benchmark names exclude the Benchmark prefix"
+
+// legacyMetrics maps the metric names used by the deprecated benchstat
+// package to units, so existing rules keep working.
+var legacyMetrics = map[string]string{
+	"time/op":  "sec/op",
+	"alloc/op": "B/op",
+	"speed":    "B/s",
+}
+
+// tidyMetric returns the metric as named in the tables, e.g. "sec/op" for
+// "ns/op" or "time/op".
+func tidyMetric(m string) string {
+	if l := legacyMetrics[m]; l != "" {
+		return l
+	}
+	if m == "" {
+		return m
+	}
+	_, m = benchunit.Tidy(1, m)
+	return m
+}
+
+// gateRules is a flag.Value for a comma separated list of gateRule.
+//
+// Each rule is "[<metric>][@<regexp>]=<percent>" or only "<percent>" to apply
+// to all benchmarks and metrics, e.g. "5%,B/op=0%,sec/op@^Hot=2%". When
+// multiple rules match a row, the last one wins, so specific rules can be
+// either tighter or looser than a general one. A percent of "off" excludes
+// the matching rows from gating, e.g. "5%,p99-ns=off".
+type gateRules []gateRule
+
+func (g *gateRules) String() string {
+	out := make([]string, len(*g))
+	for i := range *g {
+		out[i] = (*g)[i].String()
+	}
+	return strings.Join(out, ",")
+}
+
+func (g *gateRules) Set(s string) error {
+	for _, item := range strings.Split(s, ",") {
+		r := gateRule{}
+		sel, v := "", item
+		if i := strings.LastIndexByte(item, '='); i != -1 {
+			sel, v = item[:i], item[i+1:]
+		}
+		var err error
+		if v == "off" {
+			r.max = math.Inf(1)
+		} else if r.max, err = parsePercent(v); err != nil {
+			return err
+		}
+		if i := strings.IndexByte(sel, '@'); i != -1 {
+			if r.re, err = regexp.Compile(sel[i+1:]); err != nil {
+				return err
+			}
+			sel = sel[:i]
+		}
+		r.metric = tidyMetric(sel)
+		*g = append(*g, r)
+	}
+	return nil
+}
+
+// breached returns the last rule matching the row if the row's regression is
+// larger than allowed by it.
+func breached(rules []gateRule, metric string, row *row) *gateRule {
+	var rule *gateRule
+	for i := range rules {
+		if rules[i].match(metric, row.benchmark) {
+			rule = &rules[i]
+		}
+	}
+	if rule != nil && math.Abs(row.pctDelta) > rule.max*100 {
+		return rule
+	}
+	return nil
+}
+
+// breaches returns the rows in tables with a significant regression larger
+// than allowed by the last matching rule, formatted for printing.
+func breaches(tables []*table, rules []gateRule) []string {
+	var out []string
+	for _, t := range tables {
+		for _, row := range t.rows {
+			// Change is negative when the difference is significant and worse.
+			// PctDelta is negative for speed metrics that regressed.
+			if row.change >= 0 {
+				continue
+			}
+			if rule := breached(rules, t.metric, row); rule != nil {
+				out = append(out, fmt.Sprintf("%s %s: %s %s exceeds %s", row.benchmark, t.metric, row.delta, row.note, percent(rule.max).String()))
+			}
+		}
+	}
+	return out
+}
+
+// checkRegressions prints the rows breaching rules to w and returns an error
+// if there is any.
+func checkRegressions(w io.Writer, tables []*table, rules []gateRule) error {
+	b := breaches(tables, rules)
+	if len(b) == 0 {
+		return nil
+	}
+	fmt.Fprintf(w, "\nregressions above -max-regression:\n")
+	for _, l := range b {
+		fmt.Fprintf(w, "  %s\n", l)
+	}
+	return fmt.Errorf("%d benchmarks regressed", len(b))
+}
@@ -0,0 +1,76 @@
+// Copyright 2022 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+// testOld and testNew are benchmark outputs where Foo regressed and Bar
+// improved by about 10%.
+const testOld = `BenchmarkFoo 	100	  1000 ns/op
+BenchmarkFoo 	100	  1010 ns/op
+BenchmarkFoo 	100	  1005 ns/op
+BenchmarkFoo 	100	  1002 ns/op
+BenchmarkBar 	100	  1000 ns/op
+BenchmarkBar 	100	  1010 ns/op
+BenchmarkBar 	100	  1005 ns/op
+BenchmarkBar 	100	  1002 ns/op
+`
+
+const testNew = `BenchmarkFoo 	100	  1100 ns/op
+BenchmarkFoo 	100	  1110 ns/op
+BenchmarkFoo 	100	  1105 ns/op
+BenchmarkFoo 	100	  1102 ns/op
+BenchmarkBar 	100	   900 ns/op
+BenchmarkBar 	100	   910 ns/op
+BenchmarkBar 	100	   905 ns/op
+BenchmarkBar 	100	   902 ns/op
+`
+
+func getTestTables(t *testing.T) []*table {
+	a := newAnalysis()
+	tables, err := a.genBenchTables([]string{"HEAD~1", "HEAD"}, []string{testOld, testNew})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tables
+}
+
+func TestBreaches(t *testing.T) {
+	tables := getTestTables(t)
+	data := []struct {
+		rules string
+		str   string // String() if different from rules
+		want  []string
+	}{
+		{"20%", "", nil},
+		{"5%", "", []string{"Foo sec/op: +9.97% (p=0.029 n=4) exceeds 5%"}},
+		{"5%,sec/op@Foo=10%", "", nil},
+		{"20%,@^F=5%", "", []string{"Foo sec/op: +9.97% (p=0.029 n=4) exceeds 5%"}},
+		{"B/op=0%", "", nil},
+		{"5%,sec/op@Foo=off", "", nil},
+		// Units are tidied and the legacy benchstat metric names are supported.
+		{"5%,ns/op@Foo=10%", "5%,sec/op@Foo=10%", nil},
+		{"5%,time/op@Foo=10%", "5%,sec/op@Foo=10%", nil},
+	}
+	for i, l := range data {
+		var rules gateRules
+		if err := rules.Set(l.rules); err != nil {
+			t.Fatal(err)
+		}
+		want := l.str
+		if want == "" {
+			want = l.rules
+		}
+		if s := rules.String(); s != want {
+			t.Errorf("#%d: String() = %q", i, s)
+		}
+		if got := breaches(tables, rules); !reflect.DeepEqual(got, l.want) {
+			t.Errorf("#%d: got %q, want %q", i, got, l.want)
+		}
+	}
+}
@@ -0,0 +1,114 @@
+// Copyright 2022 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"strings"
+)
+
+// githubEscaper escapes the message of a GitHub Actions workflow command.
+var githubEscaper = strings.NewReplacer("%", "%25", "\r", "%0D", "\n", "%0A")
+
+// appendFile appends the content written by fn to the file at p.
+func appendFile(p string, fn func(w io.Writer) error) error {
+	/* #nosec G304 */
+	f, err := os.OpenFile(p, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o600)
+	if err != nil {
+		return err
+	}
+	err = fn(f)
+	if err2 := f.Close(); err == nil {
+		err = err2
+	}
+	return err
+}
+
+// githubBenchstat prints the tables for GitHub Actions.
+//
+// It prints the text tables to w for the logs, followed by a workflow command
+// annotation for each significant regression: an error when it breaches
+// rules, a warning otherwise, and for each benchmark not compared: a notice.
+// The regressions in the screening tables of a run with -confirm are only
+// notices and are not counted in the step outputs, since they are not gated
+// on.
+// The tables are also written as Markdown to the job summary, and the step
+// outputs "regressions", "worst-delta" and "worst-benchmark" are set.
+func githubBenchstat(w io.Writer, tables []*table, unmatched []benchDiff, rules []gateRule) error {
+	if err := printBenchstat(w, tables); err != nil {
+		return err
+	}
+	if err := printUnmatched(w, unmatched); err != nil {
+		return err
+	}
+	regressions := 0
+	worst := 0.
+	worstDelta := "0.00%"
+	worstName := ""
+	for _, t := range tables {
+		// With -confirm, the screening tables are not gated on.
+		screening := false
+		for _, c := range t.config {
+			screening = screening || (c.key == "phase" && c.value == "screening")
+		}
+		for _, row := range t.rows {
+			if row.change >= 0 {
+				continue
+			}
+			msg := fmt.Sprintf("%s %s: %s %s", row.benchmark, t.metric, row.delta, row.note)
+			if screening {
+				if _, err := fmt.Fprintf(w, "::notice title=Benchmark regression in screening::%s\n", githubEscaper.Replace(msg)); err != nil {
+					return err
+				}
+				continue
+			}
+			regressions++
+			level := "warning"
+			if breached(rules, t.metric, row) != nil {
+				level = "error"
+			}
+			if _, err := fmt.Fprintf(w, "::%s title=Benchmark regression::%s\n", level, githubEscaper.Replace(msg)); err != nil {
+				return err
+			}
+			if d := math.Abs(row.pctDelta); d > worst {
+				worst = d
+				worstDelta = row.delta
+				worstName = row.benchmark + " " + t.metric
+			}
+		}
+	}
+	for i := range unmatched {
+		if _, err := fmt.Fprintf(w, "::notice title=Benchmark not compared::%s\n", githubEscaper.Replace(unmatched[i].String())); err != nil {
+			return err
+		}
+	}
+	if p := os.Getenv("GITHUB_STEP_SUMMARY"); p != "" {
+		err := appendFile(p, func(f io.Writer) error {
+			if _, err := fmt.Fprintf(f, "## Benchmarks\n\n"); err != nil {
+				return err
+			}
+			if err := markdownBenchstat(f, tables); err != nil {
+				return err
+			}
+			return markdownUnmatched(f, unmatched)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	if p := os.Getenv("GITHUB_OUTPUT"); p != "" {
+		err := appendFile(p, func(f io.Writer) error {
+			_, err := fmt.Fprintf(f, "regressions=%d\nworst-delta=%s\nworst-benchmark=%s\n", regressions, worstDelta, worstName)
+			return err
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,87 @@
+// Copyright 2022 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestGithubBenchstat(t *testing.T) {
+	d := t.TempDir()
+	summary := filepath.Join(d, "summary")
+	output := filepath.Join(d, "output")
+	t.Setenv("GITHUB_STEP_SUMMARY", summary)
+	t.Setenv("GITHUB_OUTPUT", output)
+	var rules gateRules
+	if err := rules.Set("5%"); err != nil {
+		t.Fatal(err)
+	}
+	buf := bytes.Buffer{}
+	if err := githubBenchstat(&buf, getTestTables(t), nil, rules); err != nil {
+		t.Fatal(err)
+	}
+	if got := buf.String(); !strings.Contains(got, "::error title=Benchmark regression::Foo sec/op: +9.97%25 (p=0.029 n=4)\n") {
+		t.Fatal(got)
+	}
+	b, err := os.ReadFile(summary)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "## Benchmarks\n\n" +
+		"| sec/op | HEAD~1 | HEAD | vs base |\n" +
+		"| :-- | --: | --: | --: |\n" +
+		"| Bar | 1003.5n ± ∞ | 903.5n ± ∞ | 🟢 -9.97% (p=0.029 n=4) |\n" +
+		"| Foo | 1.004µ ± ∞ | 1.104µ ± ∞ | 🔴 +9.97% (p=0.029 n=4) |\n"
+
+	if got := string(b); got != want {
+		t.Fatalf("got:\n%s\nwant:\n%s", got, want)
+	}
+	if b, err = os.ReadFile(output); err != nil {
+		t.Fatal(err)
+	}
+	want = "regressions=1\nworst-delta=+9.97%\nworst-benchmark=Foo sec/op\n"
+	if got := string(b); got != want {
+		t.Fatalf("got:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestGithubBenchstatConfirm(t *testing.T) {
+	d := t.TempDir()
+	output := filepath.Join(d, "output")
+	t.Setenv("GITHUB_STEP_SUMMARY", "")
+	t.Setenv("GITHUB_OUTPUT", output)
+	a := newAnalysis()
+	sides := []*side{
+		{name: "HEAD~1", runs: []string{testOld}, confirmRuns: []string{testOld}},
+		{name: "HEAD", runs: []string{testNew}, confirmRuns: []string{testOld}},
+	}
+	all, _, err := confirmTables(&a, sides, getTestTables(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var rules gateRules
+	if err = rules.Set("5%"); err != nil {
+		t.Fatal(err)
+	}
+	buf := bytes.Buffer{}
+	if err = githubBenchstat(&buf, all, nil, rules); err != nil {
+		t.Fatal(err)
+	}
+	got := buf.String()
+	if strings.Contains(got, "::error") || !strings.Contains(got, "::notice title=Benchmark regression in screening::Foo sec/op") {
+		t.Fatal(got)
+	}
+	b, err := os.ReadFile(output)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s := string(b); s != "regressions=0\nworst-delta=0.00%\nworst-benchmark=\n" {
+		t.Fatal(s)
+	}
+}
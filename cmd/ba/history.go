@@ -0,0 +1,322 @@
+// Copyright 2022 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/perf/benchmath"
+	"golang.org/x/perf/benchunit"
+)
+
+// historyRecord is one line of a store file: the samples of one metric of one
+// benchmark of a commit, measured in one run.
+type historyRecord struct {
+	SHA1      string
+	Time      time.Time         // end of the run
+	Config    map[string]string `json:",omitempty"` // e.g. goos, goarch, pkg, cpu
+	Args      string            `json:",omitempty"` // go test flags and environment variables passed through
+	Benchmark string
+	Metric    string    // tidied unit, e.g. "sec/op"
+	Values    []float64 // measured values, sorted
+}
+
+// appendHistory appends the results of the committed sides to the store dir.
+//
+// The store has one JSON lines file per commit, named after its SHA-1, so
+// runs are accumulated and a commit measured in multiple runs gets more
+// samples.
+func appendHistory(dir string, m *runMetadata, sides []*side, tables []*table) error {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return err
+	}
+	for i, s := range sides {
+		if s.dirty {
+			// Uncommitted changes are not worth tracking over time.
+			continue
+		}
+		lines := bytes.Buffer{}
+		for _, t := range tables {
+			var config map[string]string
+			if len(t.config) != 0 {
+				config = make(map[string]string, len(t.config))
+				for _, c := range t.config {
+					config[c.key] = c.value
+				}
+			}
+			for _, r := range t.rows {
+				c := r.cells[i]
+				if c == nil || len(c.values) == 0 {
+					continue
+				}
+				b, err := json.Marshal(&historyRecord{
+					SHA1:      s.sha1,
+					Time:      m.End,
+					Config:    config,
+					Args:      s.cfg.String(),
+					Benchmark: r.benchmark,
+					Metric:    t.metric,
+					Values:    c.values,
+				})
+				if err != nil {
+					return err
+				}
+				lines.Write(b)
+				lines.WriteByte('\n')
+			}
+		}
+		if lines.Len() == 0 {
+			continue
+		}
+		err := appendFile(filepath.Join(dir, s.sha1+".jsonl"), func(w io.Writer) error {
+			_, err := lines.WriteTo(w)
+			return err
+		})
+		if err != nil {
+			return err
+		}
+	}
+	fmt.Fprintf(os.Stderr, "results appended to %s\n", dir)
+	return nil
+}
+
+// historyCommit is a commit in the history and its records in the store.
+type historyCommit struct {
+	sha1    string
+	subject string
+	records []historyRecord
+}
+
+// loadHistory returns the records in the store dir of the commits, keeping the
+// commits that have at least one record.
+func loadHistory(dir string, commits []historyCommit) ([]historyCommit, error) {
+	var out []historyCommit
+	for _, c := range commits {
+		/* #nosec G304 */
+		f, err := os.Open(filepath.Join(dir, c.sha1+".jsonl"))
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		s := bufio.NewScanner(f)
+		s.Buffer(nil, 16<<20)
+		for n := 1; s.Scan(); n++ {
+			r := historyRecord{}
+			if err = json.Unmarshal(s.Bytes(), &r); err != nil {
+				_ = f.Close()
+				return nil, fmt.Errorf("%s:%d: %w", f.Name(), n, err)
+			}
+			c.records = append(c.records, r)
+		}
+		err = s.Err()
+		if err2 := f.Close(); err == nil {
+			err = err2
+		}
+		if err != nil {
+			return nil, err
+		}
+		if len(c.records) != 0 {
+			out = append(out, c)
+		}
+	}
+	return out, nil
+}
+
+// sparkTicks are the characters of the sparklines, lowest first.
+var sparkTicks = []rune("▁▂▃▄▅▆▇█")
+
+// sparkline returns a text chart of values.
+func sparkline(values []float64) string {
+	lo, hi := math.Inf(1), math.Inf(-1)
+	for _, v := range values {
+		lo = math.Min(lo, v)
+		hi = math.Max(hi, v)
+	}
+	out := make([]rune, len(values))
+	for i, v := range values {
+		j := 0
+		if hi > lo {
+			j = int((v - lo) / (hi - lo) * float64(len(sparkTicks)-1))
+		}
+		out[i] = sparkTicks[j]
+	}
+	return string(out)
+}
+
+// historyPoint is the median of the samples of a commit in a trend.
+type historyPoint struct {
+	commit *historyCommit
+	values []float64
+	center float64
+}
+
+// historyTrend is one metric of one benchmark over the commits.
+type historyTrend struct {
+	config    string // "key: value" lines, sorted, then the args
+	benchmark string
+	metric    string
+	points    []*historyPoint
+}
+
+// printHistory writes the trend of each benchmark matching re and metric,
+// which is ignored when empty, over commits, oldest first.
+func printHistory(w io.Writer, commits []historyCommit, re *regexp.Regexp, metric string) error {
+	var trends []*historyTrend
+	byKey := map[string]*historyTrend{}
+	for i := range commits {
+		c := &commits[i]
+		for _, r := range c.records {
+			if (metric != "" && r.Metric != metric) || !re.MatchString(r.Benchmark) {
+				continue
+			}
+			keys := make([]string, 0, len(r.Config))
+			for k := range r.Config {
+				keys = append(keys, k)
+			}
+			sort.Strings(keys)
+			config := ""
+			for _, k := range keys {
+				config += k + ": " + r.Config[k] + "\n"
+			}
+			if r.Args != "" {
+				config += "args: " + r.Args + "\n"
+			}
+			key := config + r.Benchmark + "\n" + r.Metric
+			t := byKey[key]
+			if t == nil {
+				t = &historyTrend{config: config, benchmark: r.Benchmark, metric: r.Metric}
+				byKey[key] = t
+				trends = append(trends, t)
+			}
+			// Runs of the same commit are merged.
+			if p := t.points; len(p) == 0 || p[len(p)-1].commit != c {
+				t.points = append(t.points, &historyPoint{commit: c})
+			}
+			p := t.points[len(t.points)-1]
+			p.values = append(p.values, r.Values...)
+		}
+	}
+	if len(trends) == 0 {
+		return errors.New("no result in the store matches")
+	}
+	sort.SliceStable(trends, func(i, j int) bool {
+		return trends[i].config < trends[j].config
+	})
+	prev := ""
+	for i, t := range trends {
+		if i > 0 {
+			if _, err := fmt.Fprintf(w, "\n"); err != nil {
+				return err
+			}
+		}
+		if t.config != prev {
+			if _, err := fmt.Fprintf(w, "%s", t.config); err != nil {
+				return err
+			}
+			prev = t.config
+		}
+		centers := make([]float64, len(t.points))
+		for j, p := range t.points {
+			s := benchmath.NewSample(p.values, &benchmath.DefaultThresholds)
+			p.center = benchmath.AssumeNothing.Summary(s, 0.95).Center
+			centers[j] = p.center
+		}
+		s := benchunit.CommonScale(centers, benchunit.ClassOf(t.metric))
+		first, last := centers[0], centers[len(centers)-1]
+		summary := s.Format(first) + " → " + s.Format(last)
+		if first != 0 && len(centers) > 1 {
+			summary += fmt.Sprintf(" (%+.2f%%)", (last/first-1)*100)
+		}
+		if _, err := fmt.Fprintf(w, "%s %s  %s  %s\n", t.benchmark, t.metric, sparkline(centers), summary); err != nil {
+			return err
+		}
+		// The first column is empty to indent the commits.
+		cols := []textColumn{{}, {margin: "  "}, {margin: "  "}, {margin: "  ", right: true}, {margin: "  ", right: true}, {margin: "  "}}
+		lines := make([][]string, 0, len(t.points))
+		for j, p := range t.points {
+			// Delta against the previous commit with results.
+			delta := ""
+			if j > 0 && centers[j-1] != 0 {
+				delta = fmt.Sprintf("%+.2f%%", (p.center/centers[j-1]-1)*100)
+			}
+			sha1 := p.commit.sha1
+			if len(sha1) > 12 {
+				sha1 = sha1[:12]
+			}
+			lines = append(lines, []string{"", sha1, p.commit.subject, s.Format(p.center), delta, "n=" + strconv.Itoa(len(p.values))})
+		}
+		if err := writeText(w, cols, lines); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// historyMain implements "ba history".
+func historyMain(args []string) error {
+	f := flag.NewFlagSet("history", flag.ExitOnError)
+	store := f.String("store", "", "directory of the results appended with ba -store")
+	bench := f.String("bench", ".", "regexp of the benchmarks to print; benchmark names exclude the Benchmark prefix")
+	metric := f.String("metric", "sec/op", "metric to print, e.g. B/op; empty for all")
+	ref := f.String("ref", "HEAD", "commitref whose first parent history is printed")
+	n := f.Int("n", 50, "maximum number of commits to look at")
+	f.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: ba history -store <dir> <flags>\n")
+		fmt.Fprintf(os.Stderr, "\n")
+		fmt.Fprintf(os.Stderr, "ba history prints the trend of benchmarks over the first parent history\n")
+		fmt.Fprintf(os.Stderr, "of -ref from the results appended to a store with ba -store, oldest\n")
+		fmt.Fprintf(os.Stderr, "commit first. Commits without results are skipped.\n")
+		fmt.Fprintf(os.Stderr, "\n")
+		f.PrintDefaults()
+	}
+	if err := f.Parse(args); err != nil {
+		return err
+	}
+	if f.NArg() != 0 {
+		return errors.New("unexpected argument")
+	}
+	if *store == "" {
+		return errors.New("specify -store")
+	}
+	if *n < 1 {
+		return errors.New("-n must be at least 1")
+	}
+	re, err := regexp.Compile(*bench)
+	if err != nil {
+		return err
+	}
+	out, err := git("log", "--first-parent", "--reverse", "--format=%H %s", "-n", strconv.Itoa(*n), *ref)
+	if err != nil {
+		return errors.New(out)
+	}
+	var commits []historyCommit
+	for _, l := range strings.Split(out, "\n") {
+		if l == "" {
+			continue
+		}
+		sha1, subject, _ := strings.Cut(l, " ")
+		commits = append(commits, historyCommit{sha1: sha1, subject: subject})
+	}
+	if commits, err = loadHistory(*store, commits); err != nil {
+		return err
+	}
+	return printHistory(os.Stdout, commits, re, tidyMetric(*metric))
+}
@@ -0,0 +1,77 @@
+// Copyright 2022 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHistory(t *testing.T) {
+	d := t.TempDir()
+	sides := []*side{
+		{name: "HEAD~1", sha1: "abc", runs: []string{testOld}},
+		{name: "HEAD", sha1: "def", runs: []string{testNew}},
+	}
+	m := newRunMetadata(nil, &options{}, sides, time.Now())
+	tables := getTestTables(t)
+	// Two runs of the same commits are merged.
+	for i := 0; i < 2; i++ {
+		if err := appendHistory(d, m, sides, tables); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Uncommitted changes are not stored.
+	sides[1].dirty = true
+	sides[1].sha1 = "ghi"
+	if err := appendHistory(d, m, sides, tables); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(d, "ghi.jsonl")); !os.IsNotExist(err) {
+		t.Fatalf("unexpected %v", err)
+	}
+
+	commits, err := loadHistory(d, []historyCommit{{sha1: "abc", subject: "one"}, {sha1: "xyz", subject: "missing"}, {sha1: "def", subject: "two"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(commits) != 2 || len(commits[0].records) != 6 || len(commits[1].records) != 4 {
+		t.Fatalf("unexpected %#v", commits)
+	}
+	b := strings.Builder{}
+	if err = printHistory(&b, commits, regexp.MustCompile("Foo"), "sec/op"); err != nil {
+		t.Fatal(err)
+	}
+	want := "Foo sec/op  ▁█  1.004µ → 1.104µ (+9.97%)\n" +
+		"  abc  one  1.004µ          n=12\n" +
+		"  def  two  1.104µ  +9.97%  n=8\n"
+	if got := b.String(); got != want {
+		t.Fatalf("got:\n%s\nwant:\n%s", got, want)
+	}
+	if err = printHistory(&b, commits, regexp.MustCompile("Baz"), ""); err == nil {
+		t.Fatal("expected error")
+	}
+}
+
+func TestSparkline(t *testing.T) {
+	data := []struct {
+		values []float64
+		want   string
+	}{
+		{[]float64{1}, "▁"},
+		{[]float64{2, 2, 2}, "▁▁▁"},
+		{[]float64{1, 2, 3, 4, 5, 6, 7, 8}, "▁▂▃▄▅▆▇█"},
+		{[]float64{10, 0, 5}, "█▁▄"},
+	}
+	for i, l := range data {
+		if got := sparkline(l.values); got != l.want {
+			t.Errorf("#%d: got %q, want %q", i, got, l.want)
+		}
+	}
+}
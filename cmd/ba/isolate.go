@@ -0,0 +1,175 @@
+// Copyright 2022 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"math"
+	"path"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// isolation controls how the benchmark processes are isolated from the rest
+// of the system. It is only supported on Linux.
+type isolation struct {
+	cpus cpuList // CPUs to pin the benchmarks to; empty for all
+	nice int     // niceness of the benchmarks; 0 to keep the current one
+}
+
+// run calls fn on a new OS thread with the isolation applied, so the
+// processes started by fn inherit it. The thread is discarded afterward, so
+// ba itself and the builds are not affected.
+func (i *isolation) run(fn func() error) error {
+	if len(i.cpus) == 0 && i.nice == 0 {
+		return fn()
+	}
+	ch := make(chan error)
+	go func() {
+		// The thread is terminated when the goroutine exits while locked.
+		runtime.LockOSThread()
+		err := i.apply()
+		if err == nil {
+			err = fn()
+		}
+		ch <- err
+	}()
+	return <-ch
+}
+
+func (i *isolation) validate() error {
+	if i.nice < -20 || i.nice > 19 {
+		return errors.New("-nice must be between -20 and 19")
+	}
+	if !isolationSupported && (len(i.cpus) != 0 || i.nice != 0) {
+		return errors.New("-cpus and -nice are only supported on linux")
+	}
+	return nil
+}
+
+// cpuList is a flag.Value for a list of CPUs in the cpuset syntax, e.g.
+// "2,3,6-7".
+type cpuList []int
+
+func (c *cpuList) String() string {
+	var out []string
+	for i := 0; i < len(*c); {
+		j := i
+		for j+1 < len(*c) && (*c)[j+1] == (*c)[j]+1 {
+			j++
+		}
+		s := strconv.Itoa((*c)[i])
+		if j != i {
+			s += "-" + strconv.Itoa((*c)[j])
+		}
+		out = append(out, s)
+		i = j + 1
+	}
+	return strings.Join(out, ",")
+}
+
+func (c *cpuList) Set(s string) error {
+	seen := map[int]bool{}
+	*c = nil
+	for _, item := range strings.Split(s, ",") {
+		lo, hi, isRange := strings.Cut(item, "-")
+		first, err := strconv.Atoi(lo)
+		if err != nil || first < 0 {
+			return fmt.Errorf("invalid CPU %q", item)
+		}
+		last := first
+		if isRange {
+			if last, err = strconv.Atoi(hi); err != nil || last < first {
+				return fmt.Errorf("invalid CPU range %q", item)
+			}
+		}
+		for i := first; i <= last; i++ {
+			if !seen[i] {
+				seen[i] = true
+				*c = append(*c, i)
+			}
+		}
+	}
+	sort.Ints(*c)
+	return nil
+}
+
+// checkNoise reads the state of the system affecting the benchmarks running
+// on cpus from the Linux sysfs and procfs in fsys, rooted at "/".
+//
+// It returns a one line summary and warnings when the system is noisy.
+func checkNoise(fsys fs.FS, cpus []int) (string, []string) {
+	read := func(p string) string {
+		b, err := fs.ReadFile(fsys, p)
+		if err != nil {
+			return ""
+		}
+		return strings.TrimSpace(string(b))
+	}
+	var summary, warnings []string
+
+	// Frequency scaling makes the measurements depend on the recent load.
+	governors := map[string]cpuList{}
+	for _, c := range cpus {
+		if g := read(path.Join("sys/devices/system/cpu", "cpu"+strconv.Itoa(c), "cpufreq/scaling_governor")); g != "" {
+			governors[g] = append(governors[g], c)
+		}
+	}
+	names := make([]string, 0, len(governors))
+	for g := range governors {
+		names = append(names, g)
+	}
+	sort.Strings(names)
+	if len(names) == 1 {
+		summary = append(summary, "governor "+names[0])
+	} else if len(names) > 1 {
+		var l []string
+		for _, g := range names {
+			c := governors[g]
+			l = append(l, g+" on CPUs "+c.String())
+		}
+		summary = append(summary, "governors "+strings.Join(l, ", "))
+	}
+	for _, g := range names {
+		l := governors[g]
+		if g != "performance" {
+			warnings = append(warnings, fmt.Sprintf("CPU frequency scaling governor is %s on CPUs %s; use performance for stable results", g, l.String()))
+		}
+	}
+
+	// Turbo makes the frequency depend on the temperature and on the load of
+	// the other cores.
+	turbo := ""
+	if v := read("sys/devices/system/cpu/intel_pstate/no_turbo"); v == "0" {
+		turbo = "on"
+	} else if v == "1" {
+		turbo = "off"
+	} else if v = read("sys/devices/system/cpu/cpufreq/boost"); v == "1" {
+		turbo = "on"
+	} else if v == "0" {
+		turbo = "off"
+	}
+	if turbo != "" {
+		summary = append(summary, "turbo "+turbo)
+		if turbo == "on" {
+			warnings = append(warnings, "CPU turbo boost is enabled; disable it for stable results")
+		}
+	}
+
+	// Other processes compete for the CPUs.
+	if f := strings.Fields(read("proc/loadavg")); len(f) != 0 {
+		if load, err := strconv.ParseFloat(f[0], 64); err == nil {
+			summary = append(summary, "load average "+f[0])
+			if limit := math.Max(1, float64(len(cpus))/10); load > limit {
+				warnings = append(warnings, fmt.Sprintf("load average is %s; the system is busy", f[0]))
+			}
+		}
+	}
+	return strings.Join(summary, ", "), warnings
+}
@@ -0,0 +1,60 @@
+// Copyright 2022 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+//go:build linux
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"runtime"
+
+	"golang.org/x/sys/unix"
+)
+
+const isolationSupported = true
+
+// apply pins the current OS thread to the CPUs and sets its niceness.
+//
+// On Linux, both are per thread and inherited by the child processes started
+// from the thread.
+func (i *isolation) apply() error {
+	if len(i.cpus) != 0 {
+		set := unix.CPUSet{}
+		for _, c := range i.cpus {
+			set.Set(c)
+		}
+		if err := unix.SchedSetaffinity(0, &set); err != nil {
+			return fmt.Errorf("pinning to CPUs %s: %w", i.cpus.String(), err)
+		}
+	}
+	if i.nice != 0 {
+		// Linux' setpriority(PRIO_PROCESS, 0) applies to the calling thread.
+		if err := unix.Setpriority(unix.PRIO_PROCESS, 0, i.nice); err != nil {
+			return fmt.Errorf("setting niceness to %d: %w", i.nice, err)
+		}
+	}
+	return nil
+}
+
+// preflight prints the state of the system affecting the benchmarks and
+// warnings when it is noisy.
+func (i *isolation) preflight(w io.Writer) {
+	cpus := i.cpus
+	if len(cpus) == 0 {
+		cpus = make([]int, runtime.NumCPU())
+		for j := range cpus {
+			cpus[j] = j
+		}
+	}
+	summary, warnings := checkNoise(os.DirFS("/"), cpus)
+	if summary != "" {
+		fmt.Fprintf(w, "system: %s\n", summary)
+	}
+	for _, l := range warnings {
+		fmt.Fprintf(w, "warning: %s\n", l)
+	}
+}
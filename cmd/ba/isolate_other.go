@@ -0,0 +1,18 @@
+// Copyright 2022 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+//go:build !linux
+
+package main
+
+import "io"
+
+const isolationSupported = false
+
+func (i *isolation) apply() error {
+	return nil
+}
+
+func (i *isolation) preflight(w io.Writer) {
+}
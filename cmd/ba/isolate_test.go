@@ -0,0 +1,80 @@
+// Copyright 2022 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"reflect"
+	"testing"
+	"testing/fstest"
+)
+
+func TestCPUList(t *testing.T) {
+	data := []struct {
+		in   string
+		want cpuList
+		str  string
+	}{
+		{"3", cpuList{3}, "3"},
+		{"2,3", cpuList{2, 3}, "2-3"},
+		{"6-7,0,2-3", cpuList{0, 2, 3, 6, 7}, "0,2-3,6-7"},
+		{"1,1-2", cpuList{1, 2}, "1-2"},
+	}
+	for i, l := range data {
+		var c cpuList
+		if err := c.Set(l.in); err != nil {
+			t.Fatalf("#%d: %v", i, err)
+		}
+		if !reflect.DeepEqual(c, l.want) {
+			t.Fatalf("#%d: got %v, want %v", i, c, l.want)
+		}
+		if s := c.String(); s != l.str {
+			t.Fatalf("#%d: got %q, want %q", i, s, l.str)
+		}
+	}
+	for _, in := range []string{"", "a", "-1", "3-1", "1,"} {
+		var c cpuList
+		if err := c.Set(in); err == nil {
+			t.Fatalf("%q: expected error", in)
+		}
+	}
+}
+
+func TestCheckNoise(t *testing.T) {
+	quiet := fstest.MapFS{
+		"sys/devices/system/cpu/cpu0/cpufreq/scaling_governor": {Data: []byte("performance\n")},
+		"sys/devices/system/cpu/cpu1/cpufreq/scaling_governor": {Data: []byte("performance\n")},
+		"sys/devices/system/cpu/intel_pstate/no_turbo":         {Data: []byte("1\n")},
+		"proc/loadavg": {Data: []byte("0.12 0.30 0.25 1/523 12345\n")},
+	}
+	summary, warnings := checkNoise(quiet, []int{0, 1})
+	if summary != "governor performance, turbo off, load average 0.12" || len(warnings) != 0 {
+		t.Fatalf("%q, %q", summary, warnings)
+	}
+
+	noisy := fstest.MapFS{
+		"sys/devices/system/cpu/cpu0/cpufreq/scaling_governor": {Data: []byte("performance\n")},
+		"sys/devices/system/cpu/cpu1/cpufreq/scaling_governor": {Data: []byte("powersave\n")},
+		"sys/devices/system/cpu/cpu2/cpufreq/scaling_governor": {Data: []byte("powersave\n")},
+		"sys/devices/system/cpu/cpufreq/boost":                 {Data: []byte("1\n")},
+		"proc/loadavg":                                         {Data: []byte("3.50 2.00 1.00 4/523 12345\n")},
+	}
+	summary, warnings = checkNoise(noisy, []int{0, 1, 2})
+	if summary != "governors performance on CPUs 0, powersave on CPUs 1-2, turbo on, load average 3.50" {
+		t.Fatal(summary)
+	}
+	want := []string{
+		"CPU frequency scaling governor is powersave on CPUs 1-2; use performance for stable results",
+		"CPU turbo boost is enabled; disable it for stable results",
+		"load average is 3.50; the system is busy",
+	}
+	if !reflect.DeepEqual(warnings, want) {
+		t.Fatalf("got %q, want %q", warnings, want)
+	}
+
+	// Nothing is known, e.g. in a container.
+	if summary, warnings = checkNoise(fstest.MapFS{}, []int{0}); summary != "" || len(warnings) != 0 {
+		t.Fatalf("%q, %q", summary, warnings)
+	}
+}
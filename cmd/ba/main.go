@@ -6,23 +6,24 @@
 package main
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
 	"io"
+	"math"
+	"math/rand"
 	"os"
 	"os/exec"
 	"os/signal"
+	"path/filepath"
 	"runtime"
 	"runtime/debug"
 	"strconv"
 	"strings"
 	"time"
-
-	// TODO(maruel): Figure this out.
-	"golang.org/x/perf/benchstat"
 )
 
 func git(args ...string) (string, error) {
@@ -30,204 +31,574 @@ func git(args ...string) (string, error) {
 	return strings.TrimSpace(string(out)), err
 }
 
-func runBench(ctx context.Context, pkg, bench string, benchtime time.Duration, count int) (string, error) {
+// side is one version of the code being benchmarked.
+type side struct {
+	name    string // ref as specified by the user, e.g. "origin/main"
+	sha1    string
+	commits int // number of commits between this side and HEAD
+	// root is the root of the temporary git worktree. It is empty when the
+	// benchmarks are run in the current checkout.
+	root string
+	// dir is the directory where the packages are built. It is "." when the
+	// benchmarks are run in the current checkout, otherwise it is set by
+	// newWorktree.
+	dir string
+	// cfg is the go test flags and environment variables passed through.
+	cfg testConfig
+	// bins are the compiled test binaries, one per package.
+	bins []*testBin
+	// broken are the packages that failed to build, with the build output.
+	broken map[string]string
+	// test2json is the path to go tool test2json of the side's toolchain.
+	test2json string
+	// status is the status line shown while the test binaries run.
+	status *progress
+	// runs is the go test -bench output of each series.
+	runs []string
+	// confirmRuns is the go test -bench output of each confirmation series.
+	confirmRuns []string
+	// dirty is true when the side includes uncommitted changes, so it is not
+	// the commit sha1.
+	dirty bool
+}
+
+// newWorktree materializes the commit of s in a temporary git worktree at
+// root.
+//
+// prefix is the current directory relative to the top of the checkout, so the
+// benchmarks are run in the equivalent directory inside the worktree.
+func (s *side) newWorktree(root, prefix string) error {
+	fmt.Fprintf(os.Stderr, "git worktree add %s %s\n", root, s.name)
+	if out, err := git("worktree", "add", "--detach", root, s.sha1); err != nil {
+		return errors.New(out)
+	}
+	s.root = root
+	s.dir = filepath.Join(root, prefix)
+	return nil
+}
+
+// close removes the temporary git worktree, if any.
+func (s *side) close() error {
+	if s.root == "" {
+		return nil
+	}
+	if out, err := git("worktree", "remove", "--force", s.root); err != nil {
+		return errors.New(out)
+	}
+	return nil
+}
+
+// runBench runs the precompiled test binaries of s and returns the
+// concatenated output.
+//
+// cpu is the list of GOMAXPROCS values to run each benchmark with, e.g. "1,4".
+func runBench(ctx context.Context, s *side, bench, cpu string, benchtime time.Duration, count int) (string, error) {
 	args := []string{
-		"test",
-		"-bench", bench,
-		"-benchtime", benchtime.String(),
-		"-count", strconv.Itoa(count),
-		"-run", "^$",
-		"-cpu", "1",
-	}
-	if pkg != "" {
-		args = append(args, pkg)
-	}
-	fmt.Fprintf(os.Stderr, "go %s\n", strings.Join(args, " "))
-	/* #nosec G204 */
-	out, err := exec.CommandContext(ctx, "go", args...).CombinedOutput()
-	return string(out), err
+		"-test.benchtime", benchtime.String(),
+		"-test.count", strconv.Itoa(count),
+		"-test.run", "^$",
+		"-test.cpu", cpu,
+	}
+	out := ""
+	for _, b := range s.bins {
+		o, err := runBin(ctx, s, b, append([]string{"-test.bench", b.benchFilter(bench)}, args...))
+		out += o
+		if err != nil {
+			return out, err
+		}
+	}
+	return out, nil
 }
 
-// isPristine makes sure the tree is checked out and pristine, otherwise we
-// could loose the checkout.
-func isPristine() error {
-	diff, err := git("status", "--porcelain")
+// runBin runs the test binary b of side s from the package directory.
+func runBin(ctx context.Context, s *side, b *testBin, args []string) (string, error) {
+	args = append(args, s.cfg.run...)
+	line := append(append([]string{}, s.cfg.env...), filepath.Base(b.path))
+	fmt.Fprintf(os.Stderr, "%s: %s %s\n", s.name, strings.Join(line, " "), strings.Join(args, " "))
+	// Run through test2json to follow the benchmarks as they run and to
+	// attribute a failure to the benchmark that failed.
+	c := s.cfg.command(ctx, b.dir, s.test2json, append([]string{"-p", b.pkg, b.path}, args...)...)
+	r, err := c.StdoutPipe()
 	if err != nil {
-		return err
+		return "", err
 	}
-	if diff != "" {
-		return errors.New("the tree is modified, make sure to commit all your changes before running this script")
+	stderr := bytes.Buffer{}
+	c.Stderr = &stderr
+	if err = c.Start(); err != nil {
+		return "", err
 	}
-	return nil
+	s.status.start(s.name)
+	out, err := readEvents(r, s.status.benchmark)
+	s.status.clear()
+	if err2 := c.Wait(); err2 != nil {
+		err = err2
+	}
+	if err != nil {
+		return out.all.String(), fmt.Errorf("%s: %s failed: %w\n%s%s", s.name, b.pkg, err, out.failures(), stderr.String())
+	}
+	return out.all.String(), nil
 }
 
-func getInfos(against string) (string, int, error) {
-	// Verify current and against are different commits.
-	sha1Cur, err := git("rev-parse", "HEAD")
+// isPristine returns true if the tree has no uncommitted changes.
+func isPristine() (bool, error) {
+	diff, err := git("status", "--porcelain")
 	if err != nil {
-		return "", 0, err
+		return false, err
 	}
-	sha1Ag, err := git("rev-parse", against)
+	return diff == "", nil
+}
+
+// getInfos returns the user visible name of HEAD and the sides to benchmark:
+// the commits to benchmark against in the order specified, then HEAD last.
+//
+// against is a comma separated list of commitrefs or ranges. A range like
+// "v1.2.0..HEAD" expands to v1.2.0 followed by every commit after it, oldest
+// first. HEAD itself is skipped unless keepHead is true, e.g. to benchmark
+// uncommitted changes or to compare HEAD with itself under two configurations.
+func getInfos(against string, keepHead bool) (string, []*side, error) {
+	sha1Cur, err := git("rev-parse", "HEAD")
 	if err != nil {
-		return "", 0, err
+		return "", nil, err
 	}
-	if sha1Cur == sha1Ag {
-		return "", 0, errors.New("specify -against to state against why commit to test, e.g. -against HEAD~1")
+	var refs []string
+	for _, a := range strings.Split(against, ",") {
+		i := strings.Index(a, "..")
+		if i == -1 || strings.Contains(a, "...") {
+			refs = append(refs, a)
+			continue
+		}
+		out, err2 := git("rev-list", "--reverse", a)
+		if err2 != nil {
+			return "", nil, errors.New(out)
+		}
+		refs = append(refs, a[:i])
+		if out != "" {
+			refs = append(refs, strings.Split(out, "\n")...)
+		}
+	}
+	var sides []*side
+	seen := map[string]bool{}
+	for _, ref := range refs {
+		sha1, err2 := git("rev-parse", ref)
+		if err2 != nil {
+			return "", nil, errors.New(sha1)
+		}
+		// Verify current and against are different commits.
+		if seen[sha1] || (sha1 == sha1Cur && !keepHead) {
+			continue
+		}
+		seen[sha1] = true
+		name := ref
+		if strings.HasPrefix(sha1, ref) && len(ref) > 12 {
+			// Shorten hashes from expanded ranges.
+			name = ref[:12]
+		}
+		commits, err2 := git("rev-list", "--count", sha1Cur+"..."+sha1)
+		if err2 != nil {
+			return "", nil, errors.New(commits)
+		}
+		s := &side{name: name, sha1: sha1}
+		if s.commits, err2 = strconv.Atoi(commits); err2 != nil {
+			return "", nil, err2
+		}
+		sides = append(sides, s)
+	}
+	if len(sides) == 0 {
+		return "", nil, errors.New("specify -against to state against why commit to test, e.g. -against HEAD~1")
 	}
 
-	// Make sure we'll be able to check the commit back.
 	branch, err := git("rev-parse", "--abbrev-ref", "HEAD")
 	if err != nil {
-		return "", 0, err
+		return "", nil, err
 	}
 	if branch == "HEAD" {
-		// We're in detached head. It's fine, just save the head.
+		// We're in detached head. It's fine, just print the hash.
 		branch = sha1Cur[:16]
 	}
+	return branch, append(sides, &side{name: "HEAD", sha1: sha1Cur}), nil
+}
 
-	commitsHashes, err := git("log", "--format='%h'", sha1Cur+"..."+sha1Ag)
-	if err != nil {
-		return "", 0, err
+func warmBench(ctx context.Context, sides []*side, bench, cpu string, benchtime time.Duration) error {
+	fmt.Fprintf(os.Stderr, "warming up\n")
+	for _, s := range sides {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if _, err := runBench(ctx, s, bench, cpu, benchtime, 1); err != nil {
+			return err
+		}
 	}
-	commits := strings.Count(commitsHashes, "\n") + 1
-	return branch, commits, nil
+	return nil
 }
 
-func warmBench(ctx context.Context, branch, against, pkg, bench string, benchtime time.Duration) error {
-	fmt.Fprintf(os.Stderr, "warming up\n")
-	if err := ctx.Err(); err != nil {
-		return err
+// options controls how the benchmarks are run.
+type options struct {
+	against     string
+	pkg         string
+	bench       string
+	cpu         string // GOMAXPROCS values, e.g. "1,4,8"
+	benchtime   time.Duration
+	count       int
+	series      int
+	nowarm      bool
+	uncommitted bool
+
+	// order is the order of the sides in each series, one of orders. The
+	// benchmarks run individually are also shuffled unless it is "fixed".
+	// seed seeds the randomness; 0 to pick one.
+	order string
+	seed  int64
+
+	// untilStable continues running series past series until the half width
+	// of the confidence interval of every benchmark, the "±", is below
+	// stableWidth or maxTime is elapsed.
+	untilStable bool
+	stableWidth percent
+	maxTime     time.Duration
+
+	// calibrate measures the cost of each benchmark first, then runs each one
+	// individually with a number of iterations and samples fitting budget.
+	calibrate bool
+	budget    time.Duration
+
+	// isolation controls how the benchmarks are isolated from the system noise.
+	isolation isolation
+
+	// test is the go test flags and environment variables passed through to
+	// every side. baseTest and headTest are added to the base commits and to
+	// HEAD respectively.
+	test     testConfig
+	baseTest testConfig
+	headTest testConfig
+
+	// confirm is the number of series re-running only the benchmarks with a
+	// significant change after the screening series; 0 to disable.
+	confirm int
+
+	// unmatched are the benchmarks not compared because they are not present
+	// on every side. It is set by measure.
+	unmatched []benchDiff
+
+	// profile lists the profiles to capture after the measurements, only for
+	// the regressed benchmarks unless profileAll is set. They are saved in
+	// profileDir.
+	profile    profileList
+	profileAll bool
+	profileDir string
+
+	// analysis controls how the results are compared.
+	analysis analysis
+}
+
+// registerFlags registers the flags controlling how the benchmarks are run.
+func (o *options) registerFlags(f *flag.FlagSet) {
+	f.StringVar(&o.pkg, "pkg", "./...", "package to bench")
+	f.StringVar(&o.bench, "bench", ".", "benchmark to run, default to all")
+	f.StringVar(&o.cpu, "cpu", "1", "comma separated list of GOMAXPROCS values to run each benchmark with, e.g. 1,4,8; each value gets its own tables")
+	f.DurationVar(&o.benchtime, "benchtime", 100*time.Millisecond, "duration of each benchmark")
+	f.IntVar(&o.count, "count", 2, "count to run per attempt")
+	f.IntVar(&o.series, "series", 3, "series to run the benchmark; minimum number of series with -until-stable")
+	// TODO(maruel): This does not seem to help.
+	f.BoolVar(&o.nowarm, "nowarm", true, "do not run an extra warmup series")
+	f.StringVar(&o.order, "order", "random", "order of the commits in each series to avoid a systematic bias; one of fixed, abba (reversed every other series) or random; the benchmarks run individually are also shuffled unless fixed")
+	f.Int64Var(&o.seed, "seed", 0, "seed of -order random and of the benchmarks shuffling, to reproduce a run; 0 to pick one")
+	f.BoolVar(&o.untilStable, "until-stable", false, "run more series until all benchmarks are stable, up to -max-time")
+	o.stableWidth = 0.02
+	f.Var(&o.stableWidth, "stable-width", "maximum ± of the 95% confidence interval of every benchmark, relative to its center, to be considered stable with -until-stable; e.g. 2% allows ±2%")
+	f.DurationVar(&o.maxTime, "max-time", 10*time.Minute, "maximum time spent running series with -until-stable")
+	f.IntVar(&o.confirm, "confirm", 0, "series to re-run only the benchmarks with a significant change, to confirm them with as many fresh samples as the screening series; 0 to disable")
+	f.BoolVar(&o.calibrate, "calibrate", false, "measure each benchmark first, then run each one individually with its own iterations and count to fit -budget")
+	f.DurationVar(&o.budget, "budget", 0, "total time budget of the series with -calibrate; defaults to the equivalent of -benchtime x -count for each benchmark")
+	f.Var(&o.isolation.cpus, "cpus", "pin the benchmarks to these CPUs, e.g. 2,3 or 2-3; linux only")
+	f.IntVar(&o.isolation.nice, "nice", 0, "niceness of the benchmarks, from -20 (highest priority, requires privileges) to 19; linux only")
+	o.analysis.registerFlags(f)
+}
+
+func (o *options) validate() error {
+	if o.series < 1 {
+		return errors.New("-series must be at least 1")
+	}
+	if !isOrder(o.order) {
+		return errors.New("unsupported -order")
 	}
-	if _, err := runBench(ctx, pkg, bench, benchtime, 1); err != nil {
+	if o.confirm < 0 {
+		return errors.New("-confirm must be positive")
+	}
+	if !o.baseTest.isEmpty() && o.baseTest.String() == o.headTest.String() {
+		return errors.New("-base-args and -head-args are identical; use -- to pass arguments to every side")
+	}
+	for _, c := range strings.Split(o.cpu, ",") {
+		if n, err := strconv.Atoi(c); err != nil || n < 1 {
+			return fmt.Errorf("invalid -cpu value %q", c)
+		}
+	}
+	if err := o.isolation.validate(); err != nil {
 		return err
 	}
-	fmt.Fprintf(os.Stderr, "git checkout %s\n", against)
-	out, err := git("checkout", "-q", against)
-	if err == nil {
-		_, err = runBench(ctx, pkg, bench, benchtime, 1)
-	} else {
-		err = errors.New(out)
+	return o.analysis.validate()
+}
+
+// run runs one batch of benchmarks on side s.
+func (o *options) run(ctx context.Context, s *side, jobs []*job) (string, error) {
+	out := ""
+	err := o.isolation.run(func() error {
+		var err2 error
+		if o.calibrate {
+			out, err2 = runJobs(ctx, s, jobs, o.benchtime, o.count)
+		} else {
+			out, err2 = runBench(ctx, s, o.bench, o.cpu, o.benchtime, o.count)
+		}
+		return err2
+	})
+	return out, err
+}
+
+// runBenchmarks runs benchmarks on every commit specified by `against` and on
+// HEAD and returns the sides in this order, with their go test -bench=.
+// output.
+//
+// When uncommitted is true, HEAD is replaced with the current working tree
+// as-is.
+func runBenchmarks(ctx context.Context, o *options) ([]*side, error) {
+	overrides := !o.baseTest.isEmpty() || !o.headTest.isEmpty()
+	branch, sides, err := getInfos(o.against, o.uncommitted || overrides)
+	if err != nil {
+		return nil, err
 	}
-	fmt.Fprintf(os.Stderr, "git checkout %s\n", branch)
-	if out2, err2 := git("checkout", "-q", branch); err2 != nil {
-		return errors.New(out2)
+	pristine, err := isPristine()
+	if err != nil {
+		return nil, err
 	}
-	return err
+	head := sides[len(sides)-1]
+	if o.uncommitted {
+		if pristine && !overrides && len(sides) == 2 && sides[0].sha1 == head.sha1 {
+			return nil, errors.New("the tree has no uncommitted changes to benchmark against HEAD")
+		}
+		head.name = "working tree"
+		head.dir = "."
+		if !pristine {
+			branch += "+uncommitted"
+			head.dirty = true
+		}
+	} else if pristine {
+		head.dir = "."
+	}
+	seen := map[string]bool{}
+	for _, s := range sides {
+		extra := &o.baseTest
+		if s == head {
+			extra = &o.headTest
+		}
+		s.cfg = o.test.with(extra)
+		if !extra.isEmpty() {
+			// Tell apart the sides of the same commit.
+			s.name += " (" + extra.String() + ")"
+		}
+		// The columns are keyed by name, so they would be silently merged.
+		if seen[s.name] {
+			return nil, fmt.Errorf("%s is specified twice", s.name)
+		}
+		seen[s.name] = true
+	}
+	fmt.Fprintf(os.Stderr, "%s...%s (%d commits), %s x %d times/batch, batch repeated %d times.\n", branch, o.against, sides[0].commits, o.benchtime, o.count, o.series)
+	return sides, measure(ctx, o, sides)
 }
 
-// runBenchmarks runs benchmarks and return the go test -bench=. result for
-// (old, new) where old is `against` and new is HEAD.
-func runBenchmarks(ctx context.Context, against, pkg, bench string, benchtime time.Duration, count, series int, nowarm bool) (string, string, error) {
-	if err := isPristine(); err != nil {
-		return "", "", err
+// measure runs the benchmarks on each side in alternation and accumulates the
+// go test -bench=. output of each series in each side's runs.
+//
+// Each side that doesn't have a dir set is materialized in a temporary git
+// worktree so the current checkout is never touched.
+//
+// The test binaries are built once per side up front, then executed directly
+// in alternation so the build is not part of the timing window.
+func measure(ctx context.Context, o *options, sides []*side) (err error) {
+	o.isolation.preflight(os.Stderr)
+	prefix, err := git("rev-parse", "--show-prefix")
+	if err != nil {
+		return err
 	}
-	branch, commits, err := getInfos(against)
+	tmp, err := os.MkdirTemp("", "ba")
 	if err != nil {
-		return "", "", err
+		return err
 	}
+	defer func() {
+		if err2 := os.RemoveAll(tmp); err == nil {
+			err = err2
+		}
+	}()
+	for i, s := range sides {
+		if s.dir != "" {
+			continue
+		}
+		if err = s.newWorktree(filepath.Join(tmp, strconv.Itoa(i)), prefix); err != nil {
+			return err
+		}
+		defer func(s *side) {
+			if err2 := s.close(); err == nil {
+				err = err2
+			}
+		}(s)
+	}
+	// Run the last side, usually HEAD, first.
+	order := make([]*side, 0, len(sides))
+	order = append(order, sides[len(sides)-1])
+	order = append(order, sides[:len(sides)-1]...)
+	p := newProgress()
+	for i, s := range order {
+		if err = buildTestBins(ctx, s, o.pkg, filepath.Join(tmp, "bin", strconv.Itoa(i))); err != nil {
+			return err
+		}
+		s.status = p
+	}
+
+	p.set("listing", 0)
+	if o.unmatched, err = commonBenchmarks(ctx, sides, o.bench); err != nil {
+		return err
+	}
+	for i := range o.unmatched {
+		fmt.Fprintf(os.Stderr, "not compared: %s\n", o.unmatched[i].String())
+	}
+
+	if o.seed == 0 {
+		o.seed = time.Now().UnixNano()
+	}
+	fmt.Fprintf(os.Stderr, "order %s, seed %d\n", o.order, o.seed)
+	/* #nosec G404 */
+	rng := rand.New(rand.NewSource(o.seed))
 
-	// TODO(maruel): Make it smart, where it does series until the numbers
-	// becomes stable, and actively ignores the higher values.
-	// TODO(maruel): When a benchmark takes more than benchtime*count, reduce its
-	// count to 1. We could do this by running -benchtime=1x -json.
-	// This is particularly problematic with benchmarks lasting less than 100ns
-	// per operation as they fail to be numerically stable and deviate by ~3%.
-	if !nowarm {
-		if err = warmBench(ctx, branch, against, pkg, bench, benchtime); err != nil {
-			return "", "", err
+	// TODO(maruel): Actively ignore the higher values.
+	var jobs []*job
+	if o.calibrate {
+		p.set("calibration", 0)
+		if jobs, err = calibrate(ctx, sides, o.bench, o.cpu, o.benchtime/10); err != nil {
+			return err
+		}
+		budget := o.budget
+		if budget == 0 {
+			budget = time.Duration(len(jobs)*len(sides)*o.series*o.count) * o.benchtime
+		}
+		schedule(jobs, o.benchtime, budget, o.series, len(sides))
+		for _, j := range jobs {
+			fmt.Fprintf(os.Stderr, "%s %s: %s/op; %d x %d iterations/batch\n", j.pkg, j.fullName(), time.Duration(j.cost*1e9), j.count, j.iters)
+		}
+	} else if !o.nowarm {
+		p.set("warmup", 0)
+		if err = warmBench(ctx, order, o.bench, o.cpu, o.benchtime); err != nil {
+			return err
 		}
 	}
 
 	// Run the benchmarks.
-	oldStats := ""
-	newStats := ""
-	needRevert := false
-	fmt.Fprintf(os.Stderr, "%s...%s (%d commits), %s x %d times/batch, batch repeated %d times.\n", branch, against, commits, benchtime, count, series)
-	for i := 0; i < series; i++ {
+	start := time.Now()
+	for i := 0; ; i++ {
 		if ctx.Err() != nil {
 			// Don't error out, just quit.
 			break
 		}
-		out := ""
-		out, err = runBench(ctx, pkg, bench, benchtime, count)
-		if err != nil {
-			break
-		}
-		newStats += out
-
-		fmt.Fprintf(os.Stderr, "git checkout %s\n", against)
-		needRevert = true
-		if out, err = git("checkout", "-q", against); err != nil {
-			err = errors.New(out)
-			break
-		}
-		out, err = runBench(ctx, pkg, bench, benchtime, count)
-		if err != nil {
-			break
+		if i >= o.series {
+			if !o.untilStable {
+				break
+			}
+			var t []*table
+			if t, err = o.analysis.genBenchTables(sidesStats(sides)); err != nil {
+				break
+			}
+			u := unstable(t, float64(o.stableWidth))
+			if len(u) == 0 {
+				fmt.Fprintf(os.Stderr, "all benchmarks are stable after %d series.\n", i)
+				break
+			}
+			// Do not start a series that would not complete within the budget.
+			if elapsed := time.Since(start); elapsed+elapsed/time.Duration(i) > o.maxTime {
+				printUnstable(os.Stderr, u, i)
+				break
+			}
+			fmt.Fprintf(os.Stderr, "%d benchmarks are not stable after %d series.\n", len(u), i)
 		}
-		oldStats += out
-		fmt.Fprintf(os.Stderr, "git checkout %s\n", branch)
-		if out, err = git("checkout", "-q", branch); err != nil {
-			err = errors.New(out)
-			break
+		for j, s := range seriesOrder(o.order, i, order, rng) {
+			if i < o.series {
+				p.set(fmt.Sprintf("series %d/%d", i+1, o.series), eta(start, i*len(order)+j, o.series*len(order)))
+			} else {
+				p.set(fmt.Sprintf("series %d (until stable)", i+1), 0)
+			}
+			out := ""
+			if out, err = o.run(ctx, s, shuffleJobs(o.order, jobs, rng)); err != nil {
+				return err
+			}
+			s.runs = append(s.runs, out)
 		}
-		needRevert = false
 	}
-	if needRevert {
-		fmt.Fprintf(os.Stderr, "Checking out %s\n", branch)
-		out := ""
-		if out, err = git("checkout", "-q", branch); err != nil {
-			err = errors.New(out)
-		}
+	if err == nil && o.confirm != 0 && ctx.Err() == nil {
+		err = confirm(ctx, o, sides, order, jobs, rng)
+	}
+	if err == nil && len(o.profile) != 0 && ctx.Err() == nil {
+		err = profileBenchmarks(ctx, o, sides)
 	}
-	return oldStats, newStats, err
+	return err
 }
 
-func genBenchTables(against, head, o, n string) ([]*benchstat.Table, error) {
-	c := &benchstat.Collection{
-		Alpha:     0.05,
-		DeltaTest: benchstat.UTest,
-	}
-	// benchstat assumes that old must be first!
-	if err := c.AddFile(against, strings.NewReader(o)); err != nil {
-		return nil, err
-	}
-	if err := c.AddFile(head, strings.NewReader(n)); err != nil {
-		return nil, err
+// sidesStats returns the names and go test -bench=. outputs of sides.
+func sidesStats(sides []*side) ([]string, []string) {
+	names := make([]string, len(sides))
+	outs := make([]string, len(sides))
+	for i, s := range sides {
+		names[i] = s.name
+		outs[i] = strings.Join(s.runs, "")
 	}
-	return c.Tables(), nil
+	return names, outs
 }
 
-func printBenchstat(w io.Writer, tables []*benchstat.Table) error {
-	benchstat.FormatText(w, tables)
-	return nil
+// jsonSchemaVersion is the version of the -format json document. It is
+// incremented on incompatible changes.
+const jsonSchemaVersion = 1
+
+// jsonDocument is the -format json document.
+type jsonDocument struct {
+	Version int
+	// Run is the provenance of the results. It is omitted when unknown, e.g.
+	// when comparing files with ba report.
+	Run    *runMetadata `json:",omitempty"`
+	Tables []*jsonTable
 }
 
-func jsonBenchstat(w io.Writer, tables []*benchstat.Table) error {
+func jsonBenchstat(w io.Writer, m *runMetadata, tables []*table) error {
 	out := make([]*jsonTable, 0, len(tables))
 	for _, t := range tables {
 		outt := &jsonTable{
-			Metric:  t.Metric,
-			Unit:    t.Rows[0].Metrics[0].Unit,
-			Configs: t.Configs,
-			Rows:    make([]*jsonRow, 0, len(t.Rows)),
+			Metric:  t.metric,
+			Configs: t.configs,
+			Rows:    make([]*jsonRow, 0, len(t.rows)),
+		}
+		if len(t.config) != 0 {
+			outt.Config = make(map[string]string, len(t.config))
+			for _, c := range t.config {
+				outt.Config[c.key] = c.value
+			}
 		}
-		for _, row := range t.Rows {
+		for _, row := range t.rows {
 			r := &jsonRow{
-				Benchmark: row.Benchmark,
-				Metrics:   make([]*jsonMetrics, 0, len(row.Metrics)),
-				PctDelta:  row.PctDelta,
-				Delta:     row.Delta,
-				Note:      row.Note,
-				Change:    row.Change,
+				Benchmark: row.benchmark,
+				Metrics:   make([]*jsonMetrics, 0, len(row.cells)),
+				PctDelta:  row.pctDelta,
+				Delta:     row.delta,
+				Note:      row.note,
+				Change:    row.change,
 			}
-			for _, m := range row.Metrics {
+			for _, c := range row.cells {
+				if c == nil {
+					r.Metrics = append(r.Metrics, nil)
+					continue
+				}
 				r.Metrics = append(r.Metrics, &jsonMetrics{
-					Values:  m.Values,
-					RValues: m.RValues,
-					Min:     m.Min,
-					Mean:    m.Mean,
-					Max:     m.Max,
+					Values:   c.values,
+					Center:   c.summary.Center,
+					Lo:       finite(c.summary.Lo),
+					Hi:       finite(c.summary.Hi),
+					PctDelta: c.pctDelta,
+					Delta:    c.delta,
+					Note:     c.note,
+					Change:   c.change,
 				})
 			}
 			outt.Rows = append(outt.Rows, r)
@@ -236,31 +607,69 @@ func jsonBenchstat(w io.Writer, tables []*benchstat.Table) error {
 	}
 	e := json.NewEncoder(w)
 	e.SetIndent("", "  ")
-	return e.Encode(out)
+	return e.Encode(&jsonDocument{Version: jsonSchemaVersion, Run: m, Tables: out})
+}
+
+// finite returns a pointer to v, or nil if v is infinite since JSON can't
+// represent it.
+func finite(v float64) *float64 {
+	if math.IsInf(v, 0) || math.IsNaN(v) {
+		return nil
+	}
+	return &v
 }
 
 type jsonTable struct {
-	Metric  string
-	Unit    string
+	Config  map[string]string `json:",omitempty"` // e.g. goos, goarch, pkg, cpu
+	Metric  string            // tidied unit, e.g. "sec/op"
 	Configs []string
 	Rows    []*jsonRow
 }
 
 type jsonRow struct {
 	Benchmark string
-	Metrics   []*jsonMetrics
-	PctDelta  float64
+	Metrics   []*jsonMetrics // one per config; null when missing
+	PctDelta  float64        // last config compared to the first one
 	Delta     string
 	Note      string
 	Change    int
 }
 
 type jsonMetrics struct {
-	Values  []float64 // measured values
-	RValues []float64 // Values with outliers removed
-	Min     float64   // min of RValues
-	Mean    float64   // mean of RValues
-	Max     float64   // max of RValues
+	Values []float64 // measured values, sorted
+	Center float64   // median, or mean with -delta-test ttest
+	Lo     *float64  `json:",omitempty"` // 95% confidence interval of Center
+	Hi     *float64  `json:",omitempty"`
+	// Comparison against the first config.
+	PctDelta float64 `json:",omitempty"`
+	Delta    string  `json:",omitempty"`
+	Note     string  `json:",omitempty"`
+	Change   int     `json:",omitempty"`
+}
+
+// percent is a flag.Value for a ratio expressed as a percentage, e.g. "5%".
+type percent float64
+
+func (p percent) String() string {
+	return strconv.FormatFloat(float64(p)*100, 'g', -1, 64) + "%"
+}
+
+func (p *percent) Set(s string) error {
+	v, err := parsePercent(s)
+	*p = percent(v)
+	return err
+}
+
+// parsePercent parses a percentage like "5%" or "5" into a ratio like 0.05.
+func parsePercent(s string) (float64, error) {
+	v, err := strconv.ParseFloat(strings.TrimSuffix(s, "%"), 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid percentage %q", s)
+	}
+	if v < 0 {
+		return 0, fmt.Errorf("invalid negative percentage %q", s)
+	}
+	return v / 100, nil
 }
 
 func mainImpl() error {
@@ -268,58 +677,114 @@ func mainImpl() error {
 	// and the amount of data processed is small so GC is unnecessary.
 	runtime.LockOSThread()
 	debug.SetGCPercent(0)
-	pkg := flag.String("pkg", "./...", "package to bench")
-	bench := flag.String("bench", ".", "benchmark to run, default to all")
-	against := flag.String("against", "origin/main", "commitref to benchmark against")
-	benchtime := flag.Duration("benchtime", 100*time.Millisecond, "duration of each benchmark")
-	format := flag.String("format", "text", "format to print; either text or json")
-	count := flag.Int("count", 2, "count to run per attempt")
-	series := flag.Int("series", 3, "series to run the benchmark")
-	// TODO(maruel): This does not seem to help.
-	nowarm := flag.Bool("nowarm", true, "do not run an extra warmup series")
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, os.Interrupt)
+	go func() {
+		<-ch
+		cancel()
+	}()
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "bisect":
+			return bisectMain(ctx, os.Args[2:])
+		case "report":
+			return reportMain(os.Args[2:])
+		case "history":
+			return historyMain(os.Args[2:])
+		}
+	}
+
+	o := options{}
+	o.registerFlags(flag.CommandLine)
+	flag.StringVar(&o.against, "against", "origin/main", "commitrefs to benchmark against, comma separated; a range like v1.2.0..HEAD includes every commit in it; defaults to HEAD with -uncommitted")
+	format := flag.String("format", "text", formatHelp)
+	flag.BoolVar(&o.uncommitted, "uncommitted", false, "benchmark the working tree including uncommitted changes instead of HEAD")
+	out := flag.String("out", "", "directory to save the raw benchmark outputs, the tables and the run metadata into")
+	store := flag.String("store", "", "directory to append the results of each commit to, for ba history")
+	flag.Var(&o.baseTest, "base-args", "go test flags and environment variables for the commits benchmarked against only, space separated, e.g. '-tags purego'")
+	flag.Var(&o.headTest, "head-args", "go test flags and environment variables for HEAD only, space separated; use with -against HEAD to compare two configurations of the same commit")
+	flag.Var(&o.profile, "profile", "profiles to capture on each side after the measurements and to diff, saved in the -out directory; comma separated list of cpu, mem, block or mutex")
+	flag.BoolVar(&o.profileAll, "profile-all", false, "profile every benchmark with -profile, not only the regressed ones")
+	var maxRegression gateRules
+	flag.Var(&maxRegression, "max-regression", maxRegressionHelp)
 	flag.Usage = func() {
-		fmt.Fprintf(os.Stderr, "usage: ba <flags>\n")
+		fmt.Fprintf(os.Stderr, "usage: ba <flags> [-- <go test flags and environment variables>]\n")
+		fmt.Fprintf(os.Stderr, "       ba bisect <flags>\n")
+		fmt.Fprintf(os.Stderr, "       ba report <flags> <dir or files>\n")
+		fmt.Fprintf(os.Stderr, "       ba history -store <dir> <flags>\n")
 		fmt.Fprintf(os.Stderr, "\n")
-		fmt.Fprintf(os.Stderr, "ba (benches against) run benchmarks on two different commits and\n")
+		fmt.Fprintf(os.Stderr, "ba (benches against) run benchmarks on two or more different commits and\n")
 		fmt.Fprintf(os.Stderr, "prints out the result with benchstat.\n")
 		fmt.Fprintf(os.Stderr, "\n")
+		fmt.Fprintf(os.Stderr, "The arguments after -- are passed through to every side: build flags like\n")
+		fmt.Fprintf(os.Stderr, "-tags or -gcflags to go test -c, other flags like -benchmem or -timeout to\n")
+		fmt.Fprintf(os.Stderr, "the test binaries and KEY=VALUE as environment variables, e.g.\n")
+		fmt.Fprintf(os.Stderr, "  ba -against HEAD~1 -- -tags purego -benchmem GOEXPERIMENT=loopvar\n")
+		fmt.Fprintf(os.Stderr, "\n")
+		fmt.Fprintf(os.Stderr, "Run 'ba bisect -help' for help on finding the commit that regressed\n")
+		fmt.Fprintf(os.Stderr, "performance, 'ba report -help' to analyze saved results again and\n")
+		fmt.Fprintf(os.Stderr, "'ba history -help' to print the trend of benchmarks over commits.\n")
+		fmt.Fprintf(os.Stderr, "\n")
 		flag.PrintDefaults()
 	}
 	flag.Parse()
-	if flag.NArg() != 0 {
-		return errors.New("unexpected argument")
+	if err := o.test.parse(flag.Args()); err != nil {
+		return err
 	}
-	switch *format {
-	case "text", "json":
-	default:
+	if !isOutputFormat(*format) {
 		return errors.New("unsupported -format")
 	}
-	ctx, cancel := context.WithCancel(context.Background())
-	defer cancel()
-	ch := make(chan os.Signal, 1)
-	signal.Notify(ch, os.Interrupt)
-	go func() {
-		<-ch
-		cancel()
-	}()
+	if err := o.validate(); err != nil {
+		return err
+	}
+	if len(o.profile) != 0 {
+		if *out == "" {
+			return errors.New("-profile requires -out")
+		}
+		o.profileDir = filepath.Join(*out, "profiles")
+	}
+	if o.uncommitted {
+		againstSet := false
+		flag.Visit(func(f *flag.Flag) {
+			againstSet = againstSet || f.Name == "against"
+		})
+		if !againstSet {
+			o.against = "HEAD"
+		}
+	}
 
-	oldStats, newStats, err := runBenchmarks(ctx, *against, *pkg, *bench, *benchtime, *count, *series, *nowarm)
-	t, err2 := genBenchTables(*against, "HEAD", oldStats, newStats)
+	start := time.Now()
+	sides, err := runBenchmarks(ctx, &o)
+	t, err2 := o.analysis.genBenchTables(sidesStats(sides))
 	if err == nil {
 		err = err2
 	}
 	if err != nil {
 		return err
 	}
-	switch *format {
-	case "text":
-		err = printBenchstat(os.Stdout, t)
-	case "json":
-		err = jsonBenchstat(os.Stdout, t)
-	default:
-		err = errors.New("internal error")
+	all, gated, err := confirmTables(&o.analysis, sides, t)
+	if err != nil {
+		return err
 	}
-	return err
+	all, partial := partialRows(all)
+	o.unmatched = mergeDiffs(o.unmatched, partial)
+	m := newRunMetadata(os.Args[1:], &o, sides, start)
+	if *out != "" {
+		if err = saveResults(*out, m, sides, all); err != nil {
+			return err
+		}
+	}
+	if *store != "" {
+		if err = appendHistory(*store, m, sides, t); err != nil {
+			return err
+		}
+	}
+	if err = printTables(os.Stdout, *format, m, all, maxRegression); err != nil {
+		return err
+	}
+	return checkRegressions(os.Stderr, gated, maxRegression)
 }
 
 func main() {
@@ -6,9 +6,156 @@ package main
 
 import (
 	"bytes"
+	"flag"
+	"fmt"
+	"reflect"
+	"strings"
 	"testing"
 )
 
+// newAnalysis returns the analysis with the flags defaults.
+func newAnalysis() analysis {
+	a := analysis{}
+	a.registerFlags(flag.NewFlagSet("", flag.PanicOnError))
+	return a
+}
+
+func TestAnalysis(t *testing.T) {
+	def := newAnalysis()
+	data := []struct {
+		a     func(a *analysis)
+		delta string
+		note  string
+		rows  int
+	}{
+		{func(a *analysis) {}, "+9.97%", "(p=0.029 n=4)", 2},
+		{func(a *analysis) { a.alpha = 0.01 }, "~", "(p=0.029 n=4)", 2},
+		{func(a *analysis) { a.deltaTest = "ttest" }, "+9.96%", "(p=0.000 n=4)", 2},
+		{func(a *analysis) { a.deltaTest = "none" }, "+9.97%", "(n=4)", 2},
+		{func(a *analysis) { a.geomean = true }, "+9.97%", "(p=0.029 n=4)", 3},
+		{func(a *analysis) { a.filter = ".name:Foo" }, "+9.97%", "(p=0.029 n=4)", 1},
+	}
+	for i, l := range data {
+		a := def
+		l.a(&a)
+		if err := a.validate(); err != nil {
+			t.Fatalf("#%d: %v", i, err)
+		}
+		tables, err := a.genBenchTables([]string{"HEAD~1", "HEAD"}, []string{testOld, testNew})
+		if err != nil {
+			t.Fatalf("#%d: %v", i, err)
+		}
+		rows := tables[0].rows
+		if len(rows) != l.rows {
+			t.Fatalf("#%d: got %d rows, want %d", i, len(rows), l.rows)
+		}
+		// The rows are sorted by name.
+		foo := rows[0]
+		if l.rows > 1 {
+			foo = rows[1]
+		}
+		if foo.benchmark != "Foo" || foo.delta != l.delta || foo.note != l.note {
+			t.Errorf("#%d: got %s %q %q, want %q %q", i, foo.benchmark, foo.delta, foo.note, l.delta, l.note)
+		}
+		if a.geomean && rows[len(rows)-1].benchmark != "geomean" {
+			t.Errorf("#%d: missing geomean row", i)
+		}
+		for _, u := range unstable(tables, 1) {
+			if u.benchmark == "geomean" {
+				t.Errorf("#%d: geomean can't be unstable", i)
+			}
+		}
+	}
+	a := def
+	a.filter = "("
+	if a.validate() == nil {
+		t.Fatal("expected error")
+	}
+}
+
+func TestCustomMetrics(t *testing.T) {
+	// As reported with b.ReportMetric.
+	old := ""
+	new := ""
+	for i := 0; i < 6; i++ {
+		old += fmt.Sprintf("BenchmarkFoo \t100\t%d ns/op\t%d items/s\t%d p99-ns\n", 1000+i, 500+i, 2000+i)
+		new += fmt.Sprintf("BenchmarkFoo \t100\t%d ns/op\t%d items/s\t%d p99-ns\n", 1000+i, 400+i, 3000+i)
+	}
+	a := newAnalysis()
+	tables, err := a.genBenchTables([]string{"HEAD~1", "HEAD"}, []string{old, new})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var metrics []string
+	for _, tb := range tables {
+		metrics = append(metrics, tb.metric)
+		if c := tb.rows[0].change; c != 0 {
+			t.Errorf("%s: unexpected change %d with unknown direction", tb.metric, c)
+		}
+	}
+	if want := []string{"sec/op", "items/s", "p99-sec"}; !reflect.DeepEqual(metrics, want) {
+		t.Fatalf("got %q, want %q", metrics, want)
+	}
+
+	if err = a.better.Set("items/s=higher,p99-ns=lower"); err != nil {
+		t.Fatal(err)
+	}
+	if s := a.better.String(); s != "items/s=higher,p99-sec=lower" {
+		t.Fatal(s)
+	}
+	if tables, err = a.genBenchTables([]string{"HEAD~1", "HEAD"}, []string{old, new}); err != nil {
+		t.Fatal(err)
+	}
+	var rules gateRules
+	if err = rules.Set("5%,p99-ns=off"); err != nil {
+		t.Fatal(err)
+	}
+	got := breaches(tables, rules)
+	want := []string{"Foo items/s: -19.90% (p=0.002 n=6) exceeds 5%"}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %q, want %q", got, want)
+	}
+	for _, in := range []string{"items/s", "items/s=up"} {
+		if err = a.better.Set(in); err == nil {
+			t.Errorf("%q: expected error", in)
+		}
+	}
+}
+
+func TestGomaxprocs(t *testing.T) {
+	// As run with -test.cpu 1,4.
+	old := ""
+	new := ""
+	for i := 0; i < 4; i++ {
+		old += fmt.Sprintf("BenchmarkFoo \t100\t%d ns/op\nBenchmarkFoo-4 \t100\t%d ns/op\n", 1000+i, 500+i)
+		new += fmt.Sprintf("BenchmarkFoo \t100\t%d ns/op\nBenchmarkFoo-4 \t100\t%d ns/op\n", 1100+i, 400+i)
+	}
+	a := newAnalysis()
+	tables, err := a.genBenchTables([]string{"HEAD~1", "HEAD"}, []string{old, new})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tables) != 2 {
+		t.Fatalf("got %d tables", len(tables))
+	}
+	want := []struct {
+		procs string
+		delta string
+	}{
+		{"1", "+9.99%"},
+		{"4", "-19.94%"},
+	}
+	for i, tb := range tables {
+		got := []configValue{{key: "/gomaxprocs", value: want[i].procs}}
+		if !reflect.DeepEqual(tb.config, got) {
+			t.Errorf("#%d: got %v", i, tb.config)
+		}
+		if len(tb.rows) != 1 || tb.rows[0].benchmark != "Foo" || tb.rows[0].delta != want[i].delta {
+			t.Errorf("#%d: got %s %s", i, tb.rows[0].benchmark, tb.rows[0].delta)
+		}
+	}
+}
+
 func BenchmarkPrintBenchstat(b *testing.B) {
 	old := `BenchmarkGobEncode   	100	  13552735 ns/op	  56.63 MB/s
 BenchmarkJSONEncode  	 50	  32395067 ns/op	  59.90 MB/s
@@ -33,9 +180,10 @@ BenchmarkJSONEncode  	  50	  31765634 ns/op	  61.09 MB/s
 	x := [1024]byte{}
 	buf := bytes.NewBuffer(x[:])
 	b.ReportAllocs()
+	a := newAnalysis()
 	b.ResetTimer()
 	for i := 0; i < b.N; i++ {
-		t, err := genBenchTables("HEAD~1", "HEAD", old, new)
+		t, err := a.genBenchTables([]string{"HEAD~1", "HEAD"}, []string{old, new})
 		if err != nil {
 			b.Fatal(err)
 		}
@@ -45,3 +193,29 @@ BenchmarkJSONEncode  	  50	  31765634 ns/op	  61.09 MB/s
 		buf.Reset()
 	}
 }
+
+func TestGenBenchTablesOrder(t *testing.T) {
+	// The benchmarks ran in a random order, e.g. with -calibrate.
+	out := ""
+	for i := 0; i < 4; i++ {
+		out += fmt.Sprintf("BenchmarkFoo/size=10-2 \t100\t%d ns/op\n", 1000+i)
+		out += fmt.Sprintf("BenchmarkFoo/size=9 \t100\t%d ns/op\n", 1000+i)
+		out += fmt.Sprintf("BenchmarkFoo/size=10 \t100\t%d ns/op\n", 1000+i)
+		out += fmt.Sprintf("BenchmarkFoo/size=9-2 \t100\t%d ns/op\n", 1000+i)
+	}
+	a := newAnalysis()
+	tables, err := a.genBenchTables([]string{"HEAD~1", "HEAD"}, []string{out, out})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, tb := range tables {
+		for _, r := range tb.rows {
+			got = append(got, tb.config[0].value+" "+r.benchmark)
+		}
+	}
+	want := "1 Foo/size=9,1 Foo/size=10,2 Foo/size=9,2 Foo/size=10"
+	if s := strings.Join(got, ","); s != want {
+		t.Fatalf("got %s, want %s", s, want)
+	}
+}
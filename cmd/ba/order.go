@@ -0,0 +1,58 @@
+// Copyright 2022 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import "math/rand"
+
+// orders are the supported -order values.
+//
+// "fixed" runs the sides in the same order for every series, which is
+// sensitive to systematic bias like the thermal state or the caches warmed by
+// the previous side. "abba" reverses the order every other series.
+// "random" shuffles the sides for every series.
+var orders = []string{"fixed", "abba", "random"}
+
+func isOrder(order string) bool {
+	for _, o := range orders {
+		if o == order {
+			return true
+		}
+	}
+	return false
+}
+
+// seriesOrder returns the sides in the order to run them for series i.
+func seriesOrder(order string, i int, sides []*side, rng *rand.Rand) []*side {
+	out := make([]*side, len(sides))
+	switch order {
+	case "abba":
+		for j, s := range sides {
+			if i%2 == 1 {
+				j = len(sides) - 1 - j
+			}
+			out[j] = s
+		}
+	case "random":
+		for j, k := range rng.Perm(len(sides)) {
+			out[j] = sides[k]
+		}
+	default:
+		copy(out, sides)
+	}
+	return out
+}
+
+// shuffleJobs returns the jobs in the order to run them individually. They
+// are shuffled unless order is "fixed".
+func shuffleJobs(order string, jobs []*job, rng *rand.Rand) []*job {
+	out := make([]*job, len(jobs))
+	copy(out, jobs)
+	if order != "fixed" {
+		rng.Shuffle(len(out), func(i, j int) {
+			out[i], out[j] = out[j], out[i]
+		})
+	}
+	return out
+}
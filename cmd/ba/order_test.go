@@ -0,0 +1,76 @@
+// Copyright 2022 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"math/rand"
+	"strings"
+	"testing"
+)
+
+func TestSeriesOrder(t *testing.T) {
+	sides := []*side{{name: "A"}, {name: "B"}, {name: "C"}}
+	names := func(order string, i int, rng *rand.Rand) string {
+		var out []string
+		for _, s := range seriesOrder(order, i, sides, rng) {
+			out = append(out, s.name)
+		}
+		return strings.Join(out, "")
+	}
+	for i := 0; i < 4; i++ {
+		if got := names("fixed", i, nil); got != "ABC" {
+			t.Errorf("fixed #%d: %s", i, got)
+		}
+		want := "ABC"
+		if i%2 == 1 {
+			want = "CBA"
+		}
+		if got := names("abba", i, nil); got != want {
+			t.Errorf("abba #%d: %s", i, got)
+		}
+	}
+	// The same seed gives the same orders.
+	rng1 := rand.New(rand.NewSource(1))
+	rng2 := rand.New(rand.NewSource(1))
+	seen := map[string]bool{}
+	for i := 0; i < 20; i++ {
+		got := names("random", i, rng1)
+		if got2 := names("random", i, rng2); got != got2 {
+			t.Fatalf("#%d: %s != %s", i, got, got2)
+		}
+		seen[got] = true
+	}
+	if len(seen) < 2 {
+		t.Fatalf("not random: %v", seen)
+	}
+	if sides[0].name != "A" || sides[2].name != "C" {
+		t.Fatal("sides were modified")
+	}
+}
+
+func TestShuffleJobs(t *testing.T) {
+	var jobs []*job
+	for _, n := range []string{"A", "B", "C", "D", "E"} {
+		jobs = append(jobs, &job{name: n})
+	}
+	names := func(l []*job) string {
+		out := ""
+		for _, j := range l {
+			out += j.name
+		}
+		return out
+	}
+	if got := names(shuffleJobs("fixed", jobs, nil)); got != "ABCDE" {
+		t.Fatal(got)
+	}
+	rng := rand.New(rand.NewSource(1))
+	seen := map[string]bool{}
+	for i := 0; i < 10; i++ {
+		seen[names(shuffleJobs("abba", jobs, rng))] = true
+	}
+	if len(seen) < 2 || names(jobs) != "ABCDE" {
+		t.Fatalf("unexpected %v", seen)
+	}
+}
@@ -0,0 +1,209 @@
+// Copyright 2022 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/perf/benchfmt"
+)
+
+// profileFlags maps the supported -profile kinds to the test binary flag
+// writing the profile.
+var profileFlags = map[string]string{
+	"cpu":   "-test.cpuprofile",
+	"mem":   "-test.memprofile",
+	"block": "-test.blockprofile",
+	"mutex": "-test.mutexprofile",
+}
+
+// profileList is a flag.Value for a comma separated list of profile kinds,
+// e.g. "cpu,mem".
+type profileList []string
+
+func (p *profileList) String() string {
+	return strings.Join(*p, ",")
+}
+
+func (p *profileList) Set(s string) error {
+	*p = nil
+	for _, k := range strings.Split(s, ",") {
+		if profileFlags[k] == "" {
+			return fmt.Errorf("unsupported profile %q; expected cpu, mem, block or mutex", k)
+		}
+		*p = append(*p, k)
+	}
+	return nil
+}
+
+// benchmarks returns the benchmarks in the go test -bench output, in order.
+func benchmarks(out string) ([]*job, error) {
+	var jobs []*job
+	seen := map[string]bool{}
+	r := benchfmt.NewReader(strings.NewReader(out), "")
+	for r.Scan() {
+		res, ok := r.Result().(*benchfmt.Result)
+		if !ok {
+			continue
+		}
+		j := &job{pkg: res.GetConfig("pkg")}
+		j.name, j.cpu = splitProcs(res.Name)
+		if key := j.pkg + "\x00" + j.fullName(); !seen[key] {
+			seen[key] = true
+			jobs = append(jobs, j)
+		}
+	}
+	return jobs, r.Err()
+}
+
+// selectJobs returns the jobs with a row matching fn in tables.
+//
+// The rows are matched by package and name, which requires the rows to be the
+// benchmark full names, as with the default -row.
+func selectJobs(jobs []*job, tables []*table, fn func(r *row) bool) []*job {
+	var out []*job
+	for _, j := range jobs {
+		found := false
+		for _, t := range tables {
+			pkg, procs := "", "1"
+			for _, c := range t.config {
+				if c.key == "pkg" {
+					pkg = c.value
+				} else if c.key == "/gomaxprocs" {
+					procs = c.value
+				}
+			}
+			if pkg != "" && pkg != j.pkg {
+				continue
+			}
+			for _, r := range t.rows {
+				if fn(r) && (r.benchmark == j.fullName() || (r.benchmark == j.name && procs == strconv.Itoa(j.cpu))) {
+					found = true
+				}
+			}
+		}
+		if found {
+			out = append(out, j)
+		}
+	}
+	return out
+}
+
+// isRegressed returns true if the row has a significant regression.
+func isRegressed(r *row) bool {
+	return r.change < 0
+}
+
+// profileBenchmarks runs each benchmark individually on each side in
+// alternation with profiling enabled, then saves a pprof diff summary of the
+// last side against the first one for each profile kind.
+//
+// This is done after the measurements so the profiling overhead doesn't
+// affect them. Only the regressed benchmarks are profiled unless
+// o.profileAll is set. When interrupted, it returns nil so the measurements
+// are still reported.
+func profileBenchmarks(ctx context.Context, o *options, sides []*side) error {
+	jobs, err := benchmarks(strings.Join(sides[len(sides)-1].runs, ""))
+	if err != nil {
+		return err
+	}
+	if !o.profileAll {
+		t, err2 := o.analysis.genBenchTables(sidesStats(sides))
+		if err2 != nil {
+			return err2
+		}
+		if jobs = selectJobs(jobs, t, isRegressed); len(jobs) == 0 {
+			fmt.Fprintf(os.Stderr, "no regression to profile\n")
+			return nil
+		}
+	}
+	fmt.Fprintf(os.Stderr, "profiling %d benchmarks\n", len(jobs))
+	start := time.Now()
+	for n, j := range jobs {
+		dir := filepath.Join(o.profileDir, unsafeChars.ReplaceAllString(j.pkg+"."+j.fullName(), "_"))
+		if err = os.MkdirAll(dir, 0o700); err != nil {
+			return err
+		}
+		// paths[kind][i] is the profile of side i.
+		paths := map[string][]string{}
+		for i, s := range sides {
+			if ctx.Err() != nil {
+				// Don't error out, report the measurements.
+				return nil
+			}
+			s.status.set(fmt.Sprintf("profiling %d/%d", n+1, len(jobs)), eta(start, n*len(sides)+i, len(jobs)*len(sides)))
+			var b *testBin
+			for _, b2 := range s.bins {
+				if b2.pkg == j.pkg {
+					b = b2
+				}
+			}
+			if b == nil {
+				return fmt.Errorf("%s: package %s not found", s.name, j.pkg)
+			}
+			args := []string{
+				"-test.bench", benchRegexp(j.name),
+				"-test.benchtime", o.benchtime.String(),
+				"-test.count", "1",
+				"-test.run", "^$",
+				"-test.cpu", strconv.Itoa(j.cpu),
+			}
+			for _, k := range o.profile {
+				p := filepath.Join(dir, strconv.Itoa(i)+"-"+unsafeChars.ReplaceAllString(s.name, "_")+"."+k+".pprof")
+				if p, err = filepath.Abs(p); err != nil {
+					return err
+				}
+				args = append(args, profileFlags[k], p)
+				paths[k] = append(paths[k], p)
+			}
+			// Isolated like the measurements, e.g. so -cpus applies.
+			err = o.isolation.run(func() error {
+				_, err2 := runBin(ctx, s, b, args)
+				return err2
+			})
+			if err != nil {
+				if ctx.Err() != nil {
+					return nil
+				}
+				return err
+			}
+		}
+		for _, k := range o.profile {
+			p := paths[k]
+			if err = diffProfiles(ctx, k, p[0], p[len(p)-1], filepath.Join(dir, k+".diff.txt")); err != nil {
+				if ctx.Err() != nil {
+					return nil
+				}
+				return err
+			}
+		}
+	}
+	fmt.Fprintf(os.Stderr, "profiles saved in %s\n", o.profileDir)
+	return nil
+}
+
+// diffProfiles writes the top functions that changed the most from the
+// profile base to the profile p into dst.
+func diffProfiles(ctx context.Context, kind, base, p, dst string) error {
+	args := []string{"tool", "pprof", "-top", "-nodecount", "30", "-diff_base", base}
+	if kind == "mem" {
+		// The in-use memory at the end of a benchmark is not meaningful.
+		args = append(args, "-sample_index", "alloc_space")
+	}
+	/* #nosec G204 */
+	c := exec.CommandContext(ctx, "go", append(args, p)...)
+	out, err := c.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("go tool pprof failed: %w\n%s", err, out)
+	}
+	return os.WriteFile(dst, out, 0o600)
+}
@@ -0,0 +1,52 @@
+// Copyright 2022 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"testing"
+)
+
+func TestProfileList(t *testing.T) {
+	var p profileList
+	if err := p.Set("cpu,mem"); err != nil {
+		t.Fatal(err)
+	}
+	if s := p.String(); s != "cpu,mem" {
+		t.Fatal(s)
+	}
+	if err := p.Set("cpu,heap"); err == nil {
+		t.Fatal("expected error")
+	}
+}
+
+func TestSelectJobs(t *testing.T) {
+	jobs, err := benchmarks("pkg: demo\n" + testNew + "BenchmarkFoo-4 \t100\t900 ns/op\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, j := range jobs {
+		names = append(names, j.pkg+" "+j.fullName())
+	}
+	if len(jobs) != 3 || names[0] != "demo Foo" || names[1] != "demo Bar" || names[2] != "demo Foo-4" {
+		t.Fatalf("unexpected %q", names)
+	}
+	// Only Foo regressed, and only with GOMAXPROCS=1.
+	got := selectJobs(jobs, getTestTables(t), isRegressed)
+	if len(got) != 1 || got[0] != jobs[0] {
+		t.Fatalf("unexpected %#v", got)
+	}
+}
+
+func TestProfileBenchmarksInterrupted(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	o := options{profileAll: true, profileDir: t.TempDir(), profile: []string{"cpu"}}
+	sides := []*side{{name: "HEAD~1", runs: []string{testOld}}, {name: "HEAD", runs: []string{testNew}}}
+	if err := profileBenchmarks(ctx, &o, sides); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,109 @@
+// Copyright 2022 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/mattn/go-isatty"
+)
+
+// progress is the status line shown on a terminal while a test binary runs:
+// the phase, e.g. "series 3/10", the side, the benchmark running and the
+// estimated time left.
+//
+// The line is only shown while a test binary runs, so the other messages
+// don't need to care about it. All the methods are no-op on a nil progress.
+type progress struct {
+	w     io.Writer // nil when stderr is not a terminal
+	phase string
+	eta   time.Duration // 0 when unknown
+	side  string
+	bench string
+	width int // width of the line currently shown
+}
+
+func newProgress() *progress {
+	p := &progress{}
+	if isatty.IsTerminal(os.Stderr.Fd()) && os.Getenv("TERM") != "dumb" {
+		p.w = os.Stderr
+	}
+	return p
+}
+
+// set sets the current phase and the estimated time left.
+func (p *progress) set(phase string, eta time.Duration) {
+	if p != nil {
+		p.phase = phase
+		p.eta = eta
+	}
+}
+
+// start shows the status line for a test binary of side starting.
+func (p *progress) start(side string) {
+	if p != nil {
+		p.side = side
+		p.bench = ""
+		p.draw()
+	}
+}
+
+// benchmark updates the status line with the benchmark now running.
+func (p *progress) benchmark(name string) {
+	if p != nil {
+		p.bench = name
+		p.draw()
+	}
+}
+
+func (p *progress) draw() {
+	if p.w == nil {
+		return
+	}
+	var l []string
+	for _, v := range []string{p.phase, p.side, p.bench} {
+		if v != "" {
+			l = append(l, v)
+		}
+	}
+	if p.eta > 0 {
+		l = append(l, "ETA "+p.eta.Round(time.Second).String())
+	}
+	line := strings.Join(l, " ")
+	// Fit an 80 columns terminal, otherwise the line wraps and "\r" doesn't
+	// return to its start.
+	if r := []rune(line); len(r) > 79 {
+		line = string(r[:79])
+	}
+	n := utf8.RuneCountInString(line)
+	pad := 0
+	if p.width > n {
+		pad = p.width - n
+	}
+	fmt.Fprintf(p.w, "\r%s%s", line, strings.Repeat(" ", pad))
+	p.width = n + pad
+}
+
+// clear erases the status line.
+func (p *progress) clear() {
+	if p != nil && p.w != nil && p.width != 0 {
+		fmt.Fprintf(p.w, "\r%s\r", strings.Repeat(" ", p.width))
+		p.width = 0
+	}
+}
+
+// eta returns the estimated time left to do total runs when done runs took
+// since start.
+func eta(start time.Time, done, total int) time.Duration {
+	if done == 0 || done >= total {
+		return 0
+	}
+	return time.Since(start) / time.Duration(done) * time.Duration(total-done)
+}
@@ -0,0 +1,35 @@
+// Copyright 2022 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestProgress(t *testing.T) {
+	b := strings.Builder{}
+	p := &progress{w: &b}
+	p.set("series 2/10", 90*time.Second)
+	p.start("HEAD")
+	p.benchmark("BenchmarkLongName-8")
+	p.benchmark("BenchmarkFoo")
+	p.clear()
+	want := "\rseries 2/10 HEAD ETA 1m30s" +
+		"\rseries 2/10 HEAD BenchmarkLongName-8 ETA 1m30s" +
+		"\rseries 2/10 HEAD BenchmarkFoo ETA 1m30s       " +
+		"\r" + strings.Repeat(" ", 46) + "\r"
+	if got := b.String(); got != want {
+		t.Fatalf("%q", got)
+	}
+
+	// A nil progress is a no-op.
+	var n *progress
+	n.set("warmup", 0)
+	n.start("HEAD")
+	n.benchmark("BenchmarkFoo")
+	n.clear()
+}
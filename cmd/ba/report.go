@@ -0,0 +1,133 @@
+// Copyright 2022 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// loadResults loads go test -bench outputs and returns one side per column,
+// with the run metadata if known.
+//
+// paths is either a single results directory saved with -out, or files with
+// one column per file, oldest first.
+func loadResults(paths []string) ([]*side, *runMetadata, error) {
+	if len(paths) == 1 {
+		if fi, err := os.Stat(paths[0]); err == nil && fi.IsDir() {
+			return loadResultsDir(paths[0])
+		}
+	}
+	sides := make([]*side, len(paths))
+	for i, p := range paths {
+		/* #nosec G304 */
+		b, err := os.ReadFile(p)
+		if err != nil {
+			return nil, nil, err
+		}
+		sides[i] = &side{name: p, runs: []string{string(b)}}
+	}
+	return sides, nil, nil
+}
+
+// loadResultsDir loads the outputs of a results directory saved with -out,
+// including the confirmation series.
+func loadResultsDir(dir string) ([]*side, *runMetadata, error) {
+	/* #nosec G304 */
+	b, err := os.ReadFile(filepath.Join(dir, "metadata.json"))
+	if err != nil {
+		return nil, nil, err
+	}
+	m := &runMetadata{}
+	if err = json.Unmarshal(b, m); err != nil {
+		return nil, nil, fmt.Errorf("%s: %w", filepath.Join(dir, "metadata.json"), err)
+	}
+	if len(m.Sides) == 0 {
+		return nil, nil, fmt.Errorf("%s: no results", dir)
+	}
+	read := func(files []string) ([]string, error) {
+		var out []string
+		for _, f := range files {
+			/* #nosec G304 */
+			b, err := os.ReadFile(filepath.Join(dir, filepath.FromSlash(f)))
+			if err != nil {
+				return nil, err
+			}
+			out = append(out, string(b))
+		}
+		return out, nil
+	}
+	sides := make([]*side, len(m.Sides))
+	for i, sm := range m.Sides {
+		s := &side{name: sm.Name, sha1: sm.SHA1, commits: sm.Commits}
+		if s.runs, err = read(sm.Files); err != nil {
+			return nil, nil, err
+		}
+		if s.confirmRuns, err = read(sm.ConfirmFiles); err != nil {
+			return nil, nil, err
+		}
+		sides[i] = s
+	}
+	return sides, m, nil
+}
+
+// reportMain implements "ba report".
+func reportMain(args []string) error {
+	f := flag.NewFlagSet("report", flag.ExitOnError)
+	a := analysis{}
+	a.registerFlags(f)
+	format := f.String("format", "text", formatHelp)
+	var maxRegression gateRules
+	f.Var(&maxRegression, "max-regression", maxRegressionHelp)
+	f.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: ba report <flags> <dir>\n")
+		fmt.Fprintf(os.Stderr, "       ba report <flags> <old.txt> <new.txt>...\n")
+		fmt.Fprintf(os.Stderr, "\n")
+		fmt.Fprintf(os.Stderr, "ba report prints the tables again from results saved with -out, or\n")
+		fmt.Fprintf(os.Stderr, "from go test -bench outputs, without running the benchmarks.\n")
+		fmt.Fprintf(os.Stderr, "\n")
+		f.PrintDefaults()
+	}
+	if err := f.Parse(args); err != nil {
+		return err
+	}
+	if f.NArg() == 0 {
+		return errors.New("specify a results directory or files")
+	}
+	if !isOutputFormat(*format) {
+		return errors.New("unsupported -format")
+	}
+	if err := a.validate(); err != nil {
+		return err
+	}
+	sides, m, err := loadResults(f.Args())
+	if err != nil {
+		return err
+	}
+	t, err := a.genBenchTables(sidesStats(sides))
+	if err != nil {
+		return err
+	}
+	// Gate on the confirmation series if any, like when the benchmarks ran.
+	all, gated, err := confirmTables(&a, sides, t)
+	if err != nil {
+		return err
+	}
+	if m != nil {
+		// Like when the benchmarks ran. Without metadata, there's nowhere to
+		// list them, so they are kept.
+		var partial []benchDiff
+		all, partial = partialRows(all)
+		m.Unmatched = mergeDiffs(m.Unmatched, partial)
+	}
+	if err = printTables(os.Stdout, *format, m, all, maxRegression); err != nil {
+		return err
+	}
+	return checkRegressions(os.Stderr, gated, maxRegression)
+}
@@ -0,0 +1,88 @@
+// Copyright 2022 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestLoadResults(t *testing.T) {
+	d := t.TempDir()
+	sides := []*side{
+		{name: "HEAD~1", runs: []string{testOld[:100], testOld[100:]}},
+		{name: "HEAD", runs: []string{testNew}},
+	}
+	m := newRunMetadata(nil, &options{}, sides, time.Now())
+	if err := saveResults(d, m, sides, getTestTables(t)); err != nil {
+		t.Fatal(err)
+	}
+	loaded, m2, err := loadResults([]string{d})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m2 == nil || len(m2.Sides) != 2 {
+		t.Fatalf("unexpected metadata %#v", m2)
+	}
+	names, outs := sidesStats(loaded)
+	if want := []string{"HEAD~1", "HEAD"}; !reflect.DeepEqual(names, want) {
+		t.Fatalf("got %q, want %q", names, want)
+	}
+	if want := []string{testOld, testNew}; !reflect.DeepEqual(outs, want) {
+		t.Fatalf("got %q, want %q", outs, want)
+	}
+
+	// Files, one column per file.
+	p := filepath.Join(d, "new.txt")
+	if err = os.WriteFile(p, []byte(testNew), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if loaded, m2, err = loadResults([]string{p}); err != nil {
+		t.Fatal(err)
+	}
+	names, outs = sidesStats(loaded)
+	if !reflect.DeepEqual(names, []string{p}) || !reflect.DeepEqual(outs, []string{testNew}) || m2 != nil {
+		t.Fatalf("got %q, %q", names, outs)
+	}
+}
+
+func TestLoadResultsConfirm(t *testing.T) {
+	d := t.TempDir()
+	sides := []*side{
+		{name: "HEAD~1", runs: []string{testOld}, confirmRuns: []string{testOld, testOld}},
+		{name: "HEAD", runs: []string{testNew}, confirmRuns: []string{testOld, testOld}},
+	}
+	m := newRunMetadata(nil, &options{}, sides, time.Now())
+	if err := saveResults(d, m, sides, getTestTables(t)); err != nil {
+		t.Fatal(err)
+	}
+	loaded, _, err := loadResults([]string{d})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, s := range loaded {
+		if !reflect.DeepEqual(s.confirmRuns, sides[i].confirmRuns) {
+			t.Fatalf("%s: got %q", s.name, s.confirmRuns)
+		}
+	}
+	// The regression in screening is not confirmed, like when the benchmarks
+	// ran.
+	a := newAnalysis()
+	screening, err := a.genBenchTables(sidesStats(loaded))
+	if err != nil {
+		t.Fatal(err)
+	}
+	all, gated, err := confirmTables(&a, loaded, screening)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rules := []gateRule{{max: 0.05}}
+	if len(all) != 2 || len(breaches(all, rules)) != 1 || len(breaches(gated, rules)) != 0 {
+		t.Fatalf("unexpected %d %q", len(all), breaches(gated, rules))
+	}
+}
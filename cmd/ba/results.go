@@ -0,0 +1,163 @@
+// Copyright 2022 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// runMetadata describes a run. It is saved along the results and included in
+// the JSON output.
+type runMetadata struct {
+	Args      []string // ba command line arguments
+	GoVersion string   // version of the go toolchain that built the benchmarks
+	Hostname  string
+	GOOS      string
+	GOARCH    string
+	CPU       string `json:",omitempty"` // CPU model as reported by the benchmarks
+	Benchtime string `json:",omitempty"` // -benchtime, e.g. "100ms"
+	Count     int    `json:",omitempty"` // -count
+	Series    int    `json:",omitempty"` // number of series run
+	Order     string `json:",omitempty"` // -order
+	Seed      int64  `json:",omitempty"` // -seed, or the one picked
+	Start     time.Time
+	End       time.Time
+	// Sides are the commits benchmarked: the base commits first, HEAD last.
+	Sides []sideMetadata
+	// Unmatched are the benchmarks not compared because they are not present
+	// on every side.
+	Unmatched []benchDiff `json:",omitempty"`
+}
+
+// sideMetadata describes one side of a run.
+type sideMetadata struct {
+	Name    string
+	SHA1    string
+	Commits int // number of commits between this side and HEAD
+	// Dirty is true when the side includes uncommitted changes, so the results
+	// are not the ones of the commit SHA1.
+	Dirty bool `json:",omitempty"`
+	// Files are the raw go test -bench outputs, one per series, relative to the
+	// results directory.
+	Files []string `json:",omitempty"`
+	// ConfirmFiles are the raw outputs of the confirmation series, if any.
+	ConfirmFiles []string `json:",omitempty"`
+}
+
+// newRunMetadata returns the metadata of a run with options o that started at
+// start and just completed.
+func newRunMetadata(args []string, o *options, sides []*side, start time.Time) *runMetadata {
+	m := &runMetadata{
+		Args:      args,
+		GOOS:      runtime.GOOS,
+		GOARCH:    runtime.GOARCH,
+		CPU:       cpuModel(sides),
+		Benchtime: o.benchtime.String(),
+		Count:     o.count,
+		Order:     o.order,
+		Seed:      o.seed,
+		Start:     start.UTC(),
+		End:       time.Now().UTC(),
+		Sides:     make([]sideMetadata, len(sides)),
+		Unmatched: o.unmatched,
+	}
+	if len(sides) != 0 {
+		m.Series = len(sides[0].runs)
+	}
+	if out, err := exec.Command("go", "env", "GOVERSION").Output(); err == nil {
+		m.GoVersion = strings.TrimSpace(string(out))
+	}
+	m.Hostname, _ = os.Hostname()
+	for i, s := range sides {
+		m.Sides[i] = sideMetadata{Name: s.name, SHA1: s.sha1, Commits: s.commits, Dirty: s.dirty}
+	}
+	return m
+}
+
+// cpuModel returns the CPU model printed by the testing package in the
+// benchmark outputs, if any.
+func cpuModel(sides []*side) string {
+	for _, s := range sides {
+		for _, r := range s.runs {
+			for _, l := range strings.Split(r, "\n") {
+				if strings.HasPrefix(l, "cpu: ") {
+					return strings.TrimSpace(l[len("cpu: "):])
+				}
+			}
+		}
+	}
+	return ""
+}
+
+// unsafeChars are the characters not kept in file names.
+var unsafeChars = regexp.MustCompile(`[^A-Za-z0-9._-]+`)
+
+// saveResults saves the raw go test -bench output of each side for each
+// series, the rendered tables in every format and the run metadata into dir.
+//
+// The raw outputs are written as raw/<index>-<side>/<series>.txt, and
+// raw/<index>-<side>/confirm-<series>.txt for the confirmation series, and
+// listed in metadata.json.
+func saveResults(dir string, m *runMetadata, sides []*side, tables []*table) error {
+	for i, s := range sides {
+		d := filepath.Join("raw", strconv.Itoa(i)+"-"+unsafeChars.ReplaceAllString(s.name, "_"))
+		if err := os.MkdirAll(filepath.Join(dir, d), 0o700); err != nil {
+			return err
+		}
+		m.Sides[i].Files = nil
+		for j, r := range s.runs {
+			f := filepath.Join(d, strconv.Itoa(j+1)+".txt")
+			if err := os.WriteFile(filepath.Join(dir, f), []byte(r), 0o600); err != nil {
+				return err
+			}
+			m.Sides[i].Files = append(m.Sides[i].Files, filepath.ToSlash(f))
+		}
+		m.Sides[i].ConfirmFiles = nil
+		for j, r := range s.confirmRuns {
+			f := filepath.Join(d, "confirm-"+strconv.Itoa(j+1)+".txt")
+			if err := os.WriteFile(filepath.Join(dir, f), []byte(r), 0o600); err != nil {
+				return err
+			}
+			m.Sides[i].ConfirmFiles = append(m.Sides[i].ConfirmFiles, filepath.ToSlash(f))
+		}
+	}
+	formats := []struct {
+		name   string
+		format string
+	}{
+		{"tables.txt", "text"},
+		{"tables.json", "json"},
+		{"tables.md", "markdown"},
+		{"tables.html", "html"},
+	}
+	for _, f := range formats {
+		buf := bytes.Buffer{}
+		if err := printTables(&buf, f.format, m, tables, nil); err != nil {
+			return err
+		}
+		if err := os.WriteFile(filepath.Join(dir, f.name), buf.Bytes(), 0o600); err != nil {
+			return err
+		}
+	}
+	b, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err = os.WriteFile(filepath.Join(dir, "metadata.json"), append(b, '\n'), 0o600); err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "results saved in %s\n", dir)
+	return nil
+}
@@ -0,0 +1,63 @@
+// Copyright 2022 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestSaveResults(t *testing.T) {
+	d := t.TempDir()
+	sides := []*side{
+		{name: "HEAD~1", sha1: "abc", commits: 1, runs: []string{"cpu: Fast CPU\n" + testOld}},
+		{name: "working tree", sha1: "def", dirty: true, runs: []string{testNew}},
+	}
+	o := options{benchtime: 100 * time.Millisecond, count: 2}
+	m := newRunMetadata([]string{"-against", "HEAD~1"}, &o, sides, time.Now())
+	if err := saveResults(d, m, sides, getTestTables(t)); err != nil {
+		t.Fatal(err)
+	}
+	b, err := os.ReadFile(filepath.Join(d, "metadata.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := runMetadata{}
+	if err = json.Unmarshal(b, &got); err != nil {
+		t.Fatal(err)
+	}
+	want := []sideMetadata{
+		{Name: "HEAD~1", SHA1: "abc", Commits: 1, Files: []string{"raw/0-HEAD_1/1.txt"}},
+		{Name: "working tree", SHA1: "def", Dirty: true, Files: []string{"raw/1-working_tree/1.txt"}},
+	}
+	if !reflect.DeepEqual(got.Sides, want) {
+		t.Fatalf("got %#v, want %#v", got.Sides, want)
+	}
+	if got.CPU != "Fast CPU" || got.Benchtime != "100ms" || got.Count != 2 || got.Series != 1 {
+		t.Fatalf("unexpected metadata %#v", got)
+	}
+	if b, err = os.ReadFile(filepath.Join(d, "raw", "1-working_tree", "1.txt")); err != nil || string(b) != testNew {
+		t.Fatalf("%q, %v", b, err)
+	}
+	if b, err = os.ReadFile(filepath.Join(d, "tables.json")); err != nil {
+		t.Fatal(err)
+	}
+	doc := jsonDocument{}
+	if err = json.Unmarshal(b, &doc); err != nil {
+		t.Fatal(err)
+	}
+	if doc.Version != jsonSchemaVersion || doc.Run == nil || !reflect.DeepEqual(doc.Run.Sides, want) || len(doc.Tables) != 1 {
+		t.Fatalf("unexpected document %s", b)
+	}
+	for _, f := range []string{"tables.txt", "tables.json", "tables.md", "tables.html"} {
+		if _, err = os.Stat(filepath.Join(d, f)); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
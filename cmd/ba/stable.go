@@ -0,0 +1,65 @@
+// Copyright 2022 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"math"
+)
+
+// instability is a benchmark metric that is not stable yet.
+type instability struct {
+	metric    string
+	benchmark string
+	width     float64
+}
+
+// ciWidth returns the half width of the 95% confidence interval of the
+// summary of the samples, relative to the summary. This is the "±" printed in
+// the tables.
+//
+// It returns +Inf when there are not enough samples to tell.
+func ciWidth(c *cell) float64 {
+	s := c.summary
+	if math.IsInf(s.Lo, 0) || math.IsInf(s.Hi, 0) || math.IsNaN(s.Lo) || math.IsNaN(s.Hi) {
+		return math.Inf(1)
+	}
+	if s.Center == 0 {
+		return 0
+	}
+	return math.Max(s.Hi/s.Center-1, 1-s.Lo/s.Center)
+}
+
+// unstable returns the benchmark metrics where the confidence interval of any
+// side is wider than width.
+func unstable(tables []*table, width float64) []instability {
+	var out []instability
+	for _, t := range tables {
+		for _, r := range t.rows {
+			w := 0.
+			for _, c := range r.cells {
+				if c == nil || len(c.values) == 0 {
+					// The geometric mean row has no samples.
+					continue
+				}
+				if v := ciWidth(c); v > w {
+					w = v
+				}
+			}
+			if w > width {
+				out = append(out, instability{metric: t.metric, benchmark: r.benchmark, width: w})
+			}
+		}
+	}
+	return out
+}
+
+func printUnstable(w io.Writer, u []instability, series int) {
+	fmt.Fprintf(w, "gave up after %d series; %d benchmarks did not converge:\n", series, len(u))
+	for _, i := range u {
+		fmt.Fprintf(w, "  %s %s: ±%.1f%%\n", i.benchmark, i.metric, i.width*100)
+	}
+}
@@ -0,0 +1,55 @@
+// Copyright 2022 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"math"
+	"testing"
+
+	"golang.org/x/perf/benchmath"
+)
+
+func TestCIWidth(t *testing.T) {
+	data := []struct {
+		s    benchmath.Summary
+		want float64
+	}{
+		{benchmath.Summary{Center: 10, Lo: math.Inf(-1), Hi: math.Inf(1)}, math.Inf(1)},
+		{benchmath.Summary{Center: 0, Lo: 0, Hi: 0}, 0},
+		{benchmath.Summary{Center: 10, Lo: 10, Hi: 10}, 0},
+		{benchmath.Summary{Center: 10, Lo: 9, Hi: 10.5}, 0.1},
+		{benchmath.Summary{Center: 10, Lo: 9.5, Hi: 12}, 0.2},
+	}
+	for i, l := range data {
+		if got := ciWidth(&cell{summary: l.s}); math.Abs(got-l.want) > 1e-9 && !(math.IsInf(got, 1) && math.IsInf(l.want, 1)) {
+			t.Errorf("#%d: got %g, want %g", i, got, l.want)
+		}
+	}
+}
+
+func TestParsePercent(t *testing.T) {
+	data := []struct {
+		in   string
+		want float64
+	}{
+		{"5%", 0.05},
+		{"5", 0.05},
+		{"0.5%", 0.005},
+	}
+	for i, l := range data {
+		got, err := parsePercent(l.in)
+		if err != nil {
+			t.Fatalf("#%d: %v", i, err)
+		}
+		if math.Abs(got-l.want) > 1e-12 {
+			t.Errorf("#%d: got %g, want %g", i, got, l.want)
+		}
+	}
+	for _, in := range []string{"", "x%", "-1%"} {
+		if _, err := parsePercent(in); err == nil {
+			t.Errorf("%q: expected error", in)
+		}
+	}
+}
@@ -0,0 +1,410 @@
+// Copyright 2022 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+
+	"golang.org/x/perf/benchfmt"
+	"golang.org/x/perf/benchmath"
+	"golang.org/x/perf/benchproc"
+)
+
+// table compares one metric of the benchmarks sharing the same configuration
+// across columns. The first column is the baseline, usually the oldest
+// commit.
+type table struct {
+	// config is the configuration shared by the benchmarks in the table, e.g.
+	// goos, goarch, pkg and cpu, in the order of -table.
+	config []configValue
+	// metric is the tidied unit of the values, e.g. "sec/op" or "B/op".
+	metric string
+	// better is +1 when higher values are better, -1 when lower values are
+	// better, 0 when unknown.
+	better  int
+	configs []string // name of each column
+	rows    []*row
+}
+
+// configValue is one configuration key of a table.
+type configValue struct {
+	key   string
+	value string
+}
+
+// row is one benchmark in a table.
+type row struct {
+	benchmark string // e.g. "Foo/size=4k"; "geomean" for the geometric mean
+	// cells has one cell per column. A cell is nil when the benchmark is
+	// missing from that column.
+	cells []*cell
+	// comparison is the comparison of the last column against the first one,
+	// which is the comparison of HEAD against the base commit.
+	comparison
+}
+
+// cell is the summary of the samples of a benchmark in a column.
+type cell struct {
+	values  []float64 // samples, sorted; empty for the geometric mean
+	summary benchmath.Summary
+	// comparison is the comparison against the first column. It is zero for
+	// the first column.
+	comparison
+}
+
+// comparison is the difference between a cell and the baseline.
+type comparison struct {
+	pctDelta float64 // percentage change of the center, e.g. -9.5
+	delta    string  // pctDelta formatted, or "~" when not significant
+	note     string  // e.g. "(p=0.029 n=4)"
+	change   int     // +1 better, -1 worse, 0 unchanged or unknown
+}
+
+// analysis controls how the benchmark results are compared.
+type analysis struct {
+	alpha     float64
+	deltaTest string // one of deltaTests
+	geomean   bool   // add a geometric mean row to each table
+	filter    string // benchproc filter, e.g. ".name:Foo"
+	table     string // benchproc projection splitting results in tables
+	row       string // benchproc projection splitting results in rows
+	// better overrides the direction of improvement of metrics, e.g. for
+	// custom metrics reported with b.ReportMetric.
+	better betterMetrics
+}
+
+// betterMetrics is a flag.Value for a comma separated list of
+// <metric>=higher|lower, e.g. "items/s=higher,p99-ns=lower".
+//
+// Metrics are tidied like in the tables, so "p99-ns" is "p99-sec". It maps to
+// +1 when higher values are better and -1 when lower values are better.
+type betterMetrics map[string]int
+
+func (b *betterMetrics) String() string {
+	out := make([]string, 0, len(*b))
+	for m, v := range *b {
+		d := "lower"
+		if v > 0 {
+			d = "higher"
+		}
+		out = append(out, m+"="+d)
+	}
+	sort.Strings(out)
+	return strings.Join(out, ",")
+}
+
+func (b *betterMetrics) Set(s string) error {
+	if *b == nil {
+		*b = betterMetrics{}
+	}
+	for _, item := range strings.Split(s, ",") {
+		i := strings.LastIndexByte(item, '=')
+		if i <= 0 {
+			return fmt.Errorf("invalid %q; expected <metric>=higher|lower", item)
+		}
+		switch m := tidyMetric(item[:i]); item[i+1:] {
+		case "higher":
+			(*b)[m] = +1
+		case "lower":
+			(*b)[m] = -1
+		default:
+			return fmt.Errorf("invalid %q; expected <metric>=higher|lower", item)
+		}
+	}
+	return nil
+}
+
+// noTest summarizes like the wrapped assumption but reports every difference
+// as significant.
+type noTest struct {
+	benchmath.Assumption
+}
+
+func (noTest) Compare(s1, s2 *benchmath.Sample) benchmath.Comparison {
+	return benchmath.Comparison{N1: len(s1.Values), N2: len(s2.Values)}
+}
+
+// deltaTests are the supported significance tests, as the distributional
+// assumption to use for the samples.
+var deltaTests = map[string]benchmath.Assumption{
+	"utest": benchmath.AssumeNothing,
+	"ttest": benchmath.AssumeNormal,
+	"none":  noTest{benchmath.AssumeNothing},
+}
+
+// registerFlags registers the flags controlling how the results are compared.
+func (a *analysis) registerFlags(f *flag.FlagSet) {
+	f.Float64Var(&a.alpha, "alpha", 0.05, "significance level; a change is significant when its p-value is below alpha")
+	f.StringVar(&a.deltaTest, "delta-test", "utest", "significance test to use; one of utest (Mann-Whitney U-test, comparing medians), ttest (Welch t-test, comparing means) or none (every difference is significant)")
+	f.BoolVar(&a.geomean, "geomean", false, "add a geometric mean row to each table")
+	f.StringVar(&a.filter, "filter", "*", "only compare the benchmarks matching this benchfilter query, e.g. '.name:/^Foo/ goarch:amd64'")
+	f.StringVar(&a.table, "table", ".config,/gomaxprocs", "split the results into tables by distinct values of this projection")
+	f.StringVar(&a.row, "row", ".fullname", "split the results into rows by distinct values of this projection")
+	f.Var(&a.better, "better", "direction of improvement of custom metrics, which is unknown by default so their changes are neither improvements nor regressions; comma separated list of <metric>=higher|lower, e.g. items/s=higher,p99-ns=lower")
+}
+
+func (a *analysis) validate() error {
+	if a.alpha <= 0 || a.alpha >= 1 {
+		return errors.New("-alpha must be between 0 and 1")
+	}
+	if deltaTests[a.deltaTest] == nil {
+		return errors.New("unsupported -delta-test")
+	}
+	if _, _, _, err := a.parse(); err != nil {
+		return err
+	}
+	return nil
+}
+
+// parse parses the filter and the projections.
+func (a *analysis) parse() (*benchproc.Filter, *benchproc.Projection, *benchproc.Projection, error) {
+	filter, err := benchproc.NewFilter(a.filter)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("parsing -filter: %w", err)
+	}
+	var p benchproc.ProjectionParser
+	tableBy, _, err := p.ParseWithUnit(a.table, filter)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("parsing -table: %w", err)
+	}
+	rowBy, err := p.Parse(a.row, filter)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("parsing -row: %w", err)
+	}
+	// The columns are the inputs, so ".file" must not be part of ".config".
+	if _, err = p.Parse(".file", filter); err != nil {
+		return nil, nil, nil, err
+	}
+	return filter, tableBy, rowBy, nil
+}
+
+// genBenchTables returns the tables comparing the go test -bench=. outputs,
+// one column per output. The oldest must be first.
+func (a *analysis) genBenchTables(names, outs []string) ([]*table, error) {
+	filter, tableBy, rowBy, err := a.parse()
+	if err != nil {
+		return nil, err
+	}
+	type builder struct {
+		rows  []benchproc.Key
+		cells map[benchproc.Key][][]float64
+	}
+	builders := map[benchproc.Key]*builder{}
+	type result struct {
+		side int
+		res  *benchfmt.Result
+	}
+	var results []result
+	r := benchfmt.Reader{}
+	for i := range names {
+		r.Reset(strings.NewReader(outs[i]), names[i], ".file", names[i])
+		for r.Scan() {
+			// Syntax errors are ignored, like the rest of the go test output.
+			res, ok := r.Result().(*benchfmt.Result)
+			if !ok {
+				continue
+			}
+			if ok, _ = filter.Apply(res); !ok {
+				continue
+			}
+			results = append(results, result{i, res.Clone()})
+		}
+		if err = r.Err(); err != nil {
+			return nil, err
+		}
+	}
+	// The keys are sorted by first appearance unless the projection specifies
+	// an order. The benchmarks run in a random order with -calibrate and
+	// -confirm, so project them sorted by name for the order of the tables and
+	// the rows to be stable.
+	sort.SliceStable(results, func(i, j int) bool {
+		return naturalLess(string(results[i].res.Name), string(results[j].res.Name))
+	})
+	var keys []benchproc.Key
+	for _, x := range results {
+		rowKey := rowBy.Project(x.res)
+		for j, k := range tableBy.ProjectValues(x.res) {
+			b := builders[k]
+			if b == nil {
+				b = &builder{cells: map[benchproc.Key][][]float64{}}
+				builders[k] = b
+				keys = append(keys, k)
+			}
+			c := b.cells[rowKey]
+			if c == nil {
+				c = make([][]float64, len(names))
+				b.cells[rowKey] = c
+				b.rows = append(b.rows, rowKey)
+			}
+			c[x.side] = append(c[x.side], x.res.Values[j].Value)
+		}
+	}
+	benchproc.SortKeys(keys)
+	// The testing package omits the GOMAXPROCS suffix when it is 1. Name it
+	// explicitly when other values are present, e.g. with -cpu 1,4.
+	multiProcs := false
+	for _, k := range keys {
+		for _, f := range k.Projection().FlattenedFields() {
+			multiProcs = multiProcs || (f.Name == "/gomaxprocs" && k.Get(f) != "")
+		}
+	}
+	units := r.Units()
+	out := make([]*table, 0, len(keys))
+	for _, k := range keys {
+		b := builders[k]
+		benchproc.SortKeys(b.rows)
+		t := &table{configs: names}
+		for _, f := range k.Projection().FlattenedFields() {
+			v := k.Get(f)
+			if f.Name == "/gomaxprocs" && v == "" && multiProcs {
+				v = "1"
+			}
+			if f.Name == ".unit" {
+				t.metric = v
+			} else if v != "" {
+				t.config = append(t.config, configValue{key: f.Name, value: v})
+			}
+		}
+		t.better = units.GetBetter(t.metric)
+		if v, ok := a.better[t.metric]; ok {
+			t.better = v
+		}
+		assumption := deltaTests[a.deltaTest]
+		if units.GetAssumption(t.metric) == benchmath.AssumeExact {
+			assumption = benchmath.AssumeExact
+		}
+		thresholds := benchmath.Thresholds{CompareAlpha: a.alpha}
+		for _, rowKey := range b.rows {
+			rw := &row{benchmark: rowKey.StringValues(), cells: make([]*cell, len(names))}
+			var base *benchmath.Sample
+			for i, values := range b.cells[rowKey] {
+				if len(values) == 0 {
+					continue
+				}
+				s := benchmath.NewSample(values, &thresholds)
+				c := &cell{values: s.Values, summary: assumption.Summary(s, 0.95)}
+				if i == 0 {
+					base = s
+				} else if base != nil {
+					cmp := assumption.Compare(base, s)
+					c.comparison = a.compare(cmp, rw.cells[0].summary.Center, c.summary.Center, t.better)
+				}
+				rw.cells[i] = c
+			}
+			if last := rw.cells[len(names)-1]; last != nil {
+				rw.comparison = last.comparison
+			}
+			t.rows = append(t.rows, rw)
+		}
+		if a.geomean && len(t.rows) > 1 {
+			t.rows = append(t.rows, geomeanRow(t.rows, len(names)))
+		}
+		out = append(out, t)
+	}
+	return out, nil
+}
+
+// compare returns the comparison of the centers of two samples.
+func (a *analysis) compare(cmp benchmath.Comparison, old, new float64, better int) comparison {
+	c := comparison{delta: "~", note: "(" + cmp.String() + ")"}
+	if cmp.P >= a.alpha {
+		return c
+	}
+	if old == new {
+		c.delta = "0.00%"
+		return c
+	}
+	if old == 0 {
+		c.delta = "?"
+		return c
+	}
+	c.pctDelta = (new/old - 1) * 100
+	c.delta = fmt.Sprintf("%+.2f%%", c.pctDelta)
+	if better != 0 {
+		if (c.pctDelta > 0) == (better > 0) {
+			c.change = +1
+		} else {
+			c.change = -1
+		}
+	}
+	return c
+}
+
+// naturalLess reports whether a sorts before b, comparing the runs of digits
+// numerically, e.g. "Foo/size=9" before "Foo/size=10".
+func naturalLess(a, b string) bool {
+	for a != "" && b != "" {
+		da, db := digits(a), digits(b)
+		if da != 0 && db != 0 {
+			na, nb := strings.TrimLeft(a[:da], "0"), strings.TrimLeft(b[:db], "0")
+			if len(na) != len(nb) {
+				return len(na) < len(nb)
+			}
+			if na != nb {
+				return na < nb
+			}
+			a, b = a[da:], b[db:]
+			continue
+		}
+		if a[0] != b[0] {
+			return a[0] < b[0]
+		}
+		a, b = a[1:], b[1:]
+	}
+	return len(a) < len(b)
+}
+
+// digits returns the length of the run of digits at the start of s.
+func digits(s string) int {
+	i := 0
+	for i < len(s) && s[i] >= '0' && s[i] <= '9' {
+		i++
+	}
+	return i
+}
+
+// geomeanRow returns a row with the geometric mean of the rows in each
+// column, and the geometric mean of the ratios against the first column.
+//
+// Zero values are skipped, as they would make the geometric mean zero.
+func geomeanRow(rows []*row, columns int) *row {
+	g := &row{benchmark: "geomean", cells: make([]*cell, columns)}
+	for i := 0; i < columns; i++ {
+		logSum, n := 0., 0
+		ratioSum, ratios := 0., 0
+		for _, r := range rows {
+			c := r.cells[i]
+			if c == nil || c.summary.Center <= 0 {
+				continue
+			}
+			logSum += math.Log(c.summary.Center)
+			n++
+			if b := r.cells[0]; i != 0 && b != nil && b.summary.Center > 0 {
+				ratioSum += math.Log(c.summary.Center / b.summary.Center)
+				ratios++
+			}
+		}
+		if n == 0 {
+			continue
+		}
+		c := &cell{}
+		c.summary.Center = math.Exp(logSum / float64(n))
+		c.summary.Lo, c.summary.Hi = c.summary.Center, c.summary.Center
+		if ratios != 0 {
+			c.pctDelta = (math.Exp(ratioSum/float64(ratios)) - 1) * 100
+			c.delta = fmt.Sprintf("%+.2f%%", c.pctDelta)
+		}
+		g.cells[i] = c
+	}
+	if last := g.cells[columns-1]; last != nil {
+		g.comparison = last.comparison
+	}
+	return g
+}
@@ -0,0 +1,86 @@
+// Copyright 2022 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"strings"
+)
+
+// testEvent is an event emitted by go tool test2json. See go doc
+// cmd/test2json.
+type testEvent struct {
+	Action string
+	Test   string
+	Output string
+}
+
+// testOutput is the output of a test binary run, reassembled from its
+// events.
+type testOutput struct {
+	// all is the output as printed by the test binary.
+	all strings.Builder
+	// tests is the output of each test or benchmark that printed something.
+	tests map[string]*strings.Builder
+	// failed are the tests and benchmarks that failed, in order.
+	failed []string
+}
+
+// failures returns the output of the failed tests and benchmarks, or all the
+// output if the failure can't be attributed to one, e.g. a panic in init.
+func (t *testOutput) failures() string {
+	if len(t.failed) == 0 {
+		return t.all.String()
+	}
+	out := ""
+	for _, n := range t.failed {
+		if b := t.tests[n]; b != nil {
+			out += b.String()
+		}
+	}
+	return out
+}
+
+// readEvents reads the go tool test2json events from r until EOF.
+//
+// onBench is called with the name of each benchmark as it starts.
+func readEvents(r io.Reader, onBench func(name string)) (*testOutput, error) {
+	t := &testOutput{tests: map[string]*strings.Builder{}}
+	d := json.NewDecoder(r)
+	for {
+		e := testEvent{}
+		if err := d.Decode(&e); err != nil {
+			if err == io.EOF {
+				return t, nil
+			}
+			// Drain so the process doesn't block writing its output.
+			_, _ = io.Copy(io.Discard, r)
+			return t, err
+		}
+		switch e.Action {
+		case "run":
+			// Only with -test.v.
+			onBench(e.Test)
+		case "output":
+			t.all.WriteString(e.Output)
+			if e.Test != "" {
+				b := t.tests[e.Test]
+				if b == nil {
+					b = &strings.Builder{}
+					t.tests[e.Test] = b
+				}
+				b.WriteString(e.Output)
+			} else if strings.HasPrefix(e.Output, "Benchmark") && !strings.HasSuffix(e.Output, "\n") {
+				// The benchmark name is printed, padded, before it runs.
+				onBench(strings.TrimSpace(e.Output))
+			}
+		case "fail":
+			if e.Test != "" {
+				t.failed = append(t.failed, e.Test)
+			}
+		}
+	}
+}
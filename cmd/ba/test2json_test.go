@@ -0,0 +1,53 @@
+// Copyright 2022 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestReadEvents(t *testing.T) {
+	events := `{"Action":"start","Package":"failb"}
+{"Action":"output","Package":"failb","Output":"pkg: failb\n"}
+{"Action":"output","Package":"failb","Output":"BenchmarkOK-2  \t"}
+{"Action":"output","Package":"failb","Output":"35912982\t         0.4507 ns/op\n"}
+{"Action":"run","Package":"failb","Test":"BenchmarkBad"}
+{"Action":"output","Package":"failb","Test":"BenchmarkBad","Output":"--- FAIL: BenchmarkBad\n","OutputType":"frame"}
+{"Action":"output","Package":"failb","Test":"BenchmarkBad","Output":"    f_test.go:4: boom\n"}
+{"Action":"fail","Package":"failb","Test":"BenchmarkBad"}
+{"Action":"output","Package":"failb","Output":"FAIL\n","OutputType":"frame"}
+{"Action":"fail","Package":"failb"}
+`
+	var benches []string
+	out, err := readEvents(strings.NewReader(events), func(name string) {
+		benches = append(benches, name)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.Join(benches, ","); got != "BenchmarkOK-2,BenchmarkBad" {
+		t.Fatal(got)
+	}
+	want := "pkg: failb\nBenchmarkOK-2  \t35912982\t         0.4507 ns/op\n--- FAIL: BenchmarkBad\n    f_test.go:4: boom\nFAIL\n"
+	if got := out.all.String(); got != want {
+		t.Fatalf("%q", got)
+	}
+	if got := out.failures(); got != "--- FAIL: BenchmarkBad\n    f_test.go:4: boom\n" {
+		t.Fatalf("%q", got)
+	}
+
+	// A failure not attributed to a benchmark returns all the output.
+	if out, err = readEvents(strings.NewReader(`{"Action":"output","Output":"panic: init\n"}`+"\n"+`{"Action":"fail"}`), func(string) {}); err != nil {
+		t.Fatal(err)
+	}
+	if got := out.failures(); got != "panic: init\n" {
+		t.Fatalf("%q", got)
+	}
+
+	if _, err = readEvents(strings.NewReader("not json\n"), func(string) {}); err == nil {
+		t.Fatal("expected error")
+	}
+}
@@ -0,0 +1,409 @@
+// Copyright 2022 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// benchDiff is a benchmark or a package that is not compared because it is
+// not present, or doesn't build, on every side.
+type benchDiff struct {
+	Package string
+	// Benchmark is the benchmark name without the "Benchmark" prefix. It is
+	// empty when the whole package is not compared.
+	Benchmark string `json:",omitempty"`
+	// Metric is set when only this metric of the benchmark is missing on
+	// Sides.
+	Metric string `json:",omitempty"`
+	// Change is one of "added" (missing on the base commit), "removed"
+	// (missing on HEAD), "renamed", "missing" (on some sides in between) or
+	// "broken" (the package doesn't build on some sides).
+	Change string
+	// To is the new name when renamed. Renames are guessed from the names.
+	To string `json:",omitempty"`
+	// Sides are the sides missing the benchmark, or failing to build the
+	// package.
+	Sides []string `json:",omitempty"`
+}
+
+func (d *benchDiff) String() string {
+	if d.Change == "broken" {
+		return d.Package + ": failed to build on " + strings.Join(d.Sides, ", ")
+	}
+	out := d.Benchmark
+	if d.Package != "" {
+		out = d.Package + ": " + out
+	}
+	switch d.Change {
+	case "renamed":
+		return out + " renamed to " + d.To
+	case "missing":
+		if d.Metric != "" {
+			out += " " + d.Metric
+		}
+		return out + " missing on " + strings.Join(d.Sides, ", ")
+	default:
+		return out + " " + d.Change
+	}
+}
+
+// commonBenchmarks restricts the benchmarks run on each side to the top-level
+// benchmarks matching bench that are present on every side, so they can be
+// compared, and returns the ones that are not.
+//
+// A package failing to build on some sides is not run at all. It is an error
+// if it fails to build on every side.
+//
+// The test binaries only list the top-level benchmarks. A sub-benchmark added
+// or removed in a common benchmark is handled by partialRows.
+func commonBenchmarks(ctx context.Context, sides []*side, bench string) ([]benchDiff, error) {
+	top, rest := splitBench(bench)
+	// found[pkg][i] are the benchmarks of the package on side i. It is nil when
+	// the package doesn't exist or doesn't build there.
+	found := map[string][]map[string]bool{}
+	var pkgs []string
+	add := func(pkg string) []map[string]bool {
+		f := found[pkg]
+		if f == nil {
+			f = make([]map[string]bool, len(sides))
+			found[pkg] = f
+			pkgs = append(pkgs, pkg)
+		}
+		return f
+	}
+	broken := map[string][]string{}
+	for i, s := range sides {
+		for pkg := range s.broken {
+			add(pkg)
+			broken[pkg] = append(broken[pkg], s.name)
+		}
+		for _, b := range s.bins {
+			names, err := listBenchmarks(ctx, s, b, top)
+			if err != nil {
+				return nil, err
+			}
+			f := add(b.pkg)
+			f[i] = map[string]bool{}
+			for _, n := range names {
+				f[i][n] = true
+			}
+		}
+	}
+	sort.Strings(pkgs)
+
+	var diffs []benchDiff
+	// common is the -test.bench regexp of the packages missing benchmarks on
+	// some sides.
+	common := map[string]string{}
+	for _, pkg := range pkgs {
+		f := found[pkg]
+		if b := broken[pkg]; len(b) != 0 {
+			built := false
+			for _, m := range f {
+				built = built || m != nil
+			}
+			if !built {
+				s := sides[len(sides)-1]
+				for _, s2 := range sides {
+					if _, ok := s2.broken[pkg]; ok {
+						s = s2
+					}
+				}
+				return nil, fmt.Errorf("%s: failed to build %s\n%s", s.name, pkg, s.broken[pkg])
+			}
+			diffs = append(diffs, benchDiff{Package: pkg, Change: "broken", Sides: b})
+			common[pkg] = ""
+			continue
+		}
+		var names []string
+		for _, m := range f {
+			for n := range m {
+				names = append(names, n)
+			}
+		}
+		sort.Strings(names)
+		var same []string
+		var added, removed []benchDiff
+		for i, n := range names {
+			if i > 0 && names[i-1] == n {
+				continue
+			}
+			var missing []string
+			for j, m := range f {
+				if !m[n] {
+					missing = append(missing, sides[j].name)
+				}
+			}
+			switch first, last := f[0][n], f[len(f)-1][n]; {
+			case len(missing) == 0:
+				same = append(same, n)
+			case !first && last:
+				added = append(added, benchDiff{Package: pkg, Benchmark: n, Change: "added"})
+			case first && !last:
+				removed = append(removed, benchDiff{Package: pkg, Benchmark: n, Change: "removed"})
+			default:
+				diffs = append(diffs, benchDiff{Package: pkg, Benchmark: n, Change: "missing", Sides: missing})
+			}
+		}
+		if len(added)+len(removed) != 0 || len(same) != len(names) {
+			diffs = append(diffs, pairRenames(removed, added)...)
+			common[pkg] = restrictBench(same, rest)
+		}
+	}
+	diffs = mergeDiffs(nil, diffs)
+
+	for _, s := range sides {
+		var bins []*testBin
+		for _, b := range s.bins {
+			re, ok := common[b.pkg]
+			if !ok {
+				bins = append(bins, b)
+			} else if re != "" {
+				b.bench = re
+				bins = append(bins, b)
+			}
+		}
+		s.bins = bins
+	}
+	return diffs, nil
+}
+
+// partialRows removes the rows missing a column from the tables, e.g. a
+// sub-benchmark added in a common benchmark, and returns them. The geometric
+// mean rows are recomputed without them and the tables left empty are
+// removed.
+//
+// A benchmark is only reported as added or removed when it is missing from
+// every table on a side. Otherwise only a metric is missing, e.g. B/op when
+// one side runs with -benchmem or calls b.ReportAllocs().
+func partialRows(tables []*table) ([]*table, []benchDiff) {
+	// found has the benchmarks present in at least one table of each side.
+	found := map[string]bool{}
+	for _, t := range tables {
+		pkg := tablePkg(t)
+		for _, r := range t.rows {
+			for j, c := range r.cells {
+				if c != nil {
+					found[pkg+"\x00"+r.benchmark+"\x00"+t.configs[j]] = true
+				}
+			}
+		}
+	}
+	var diffs []benchDiff
+	out := make([]*table, 0, len(tables))
+	for _, t := range tables {
+		pkg := tablePkg(t)
+		rows := make([]*row, 0, len(t.rows))
+		geomean := false
+		for i, r := range t.rows {
+			if i == len(t.rows)-1 && r.benchmark == "geomean" {
+				geomean = true
+				continue
+			}
+			var missing []string
+			metric := false
+			for j, c := range r.cells {
+				if c == nil {
+					missing = append(missing, t.configs[j])
+					metric = metric || found[pkg+"\x00"+r.benchmark+"\x00"+t.configs[j]]
+				}
+			}
+			if len(missing) == 0 {
+				rows = append(rows, r)
+				continue
+			}
+			d := benchDiff{Package: pkg, Benchmark: r.benchmark, Change: "missing", Sides: missing}
+			if metric {
+				d.Metric = t.metric
+			} else if first, last := r.cells[0] != nil, r.cells[len(r.cells)-1] != nil; !first && last {
+				d.Change, d.Sides = "added", nil
+			} else if first && !last {
+				d.Change, d.Sides = "removed", nil
+			}
+			diffs = append(diffs, d)
+		}
+		if len(rows) == len(t.rows) {
+			out = append(out, t)
+			continue
+		}
+		if geomean && len(rows) > 1 {
+			rows = append(rows, geomeanRow(rows, len(t.configs)))
+		}
+		if len(rows) != 0 {
+			t.rows = rows
+			out = append(out, t)
+		}
+	}
+	return out, mergeDiffs(nil, diffs)
+}
+
+// tablePkg returns the package of the table, if known.
+func tablePkg(t *table) string {
+	for _, c := range t.config {
+		if c.key == "pkg" {
+			return c.value
+		}
+	}
+	return ""
+}
+
+// mergeDiffs returns the benchmarks not compared of a and b, sorted by package,
+// benchmark and metric, without duplicates, e.g. the same benchmark missing in
+// the table of each metric.
+func mergeDiffs(a, b []benchDiff) []benchDiff {
+	var out []benchDiff
+	seen := map[string]bool{}
+	for _, l := range [][]benchDiff{a, b} {
+		for _, d := range l {
+			if key := d.Package + "\x00" + d.Benchmark + "\x00" + d.Metric; !seen[key] {
+				seen[key] = true
+				out = append(out, d)
+			}
+		}
+	}
+	sort.SliceStable(out, func(i, j int) bool {
+		if out[i].Package != out[j].Package {
+			return out[i].Package < out[j].Package
+		}
+		if out[i].Benchmark != out[j].Benchmark {
+			return out[i].Benchmark < out[j].Benchmark
+		}
+		return out[i].Metric < out[j].Metric
+	})
+	return out
+}
+
+// listBenchmarks returns the top-level benchmarks of b matching the regexp
+// top, without the "Benchmark" prefix.
+func listBenchmarks(ctx context.Context, s *side, b *testBin, top string) ([]string, error) {
+	out, err := runBin(ctx, s, b, []string{"-test.list", top})
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, l := range strings.Split(out, "\n") {
+		if strings.HasPrefix(l, "Benchmark") {
+			names = append(names, strings.TrimPrefix(l, "Benchmark"))
+		}
+	}
+	return names, nil
+}
+
+// splitBench splits a -bench regexp into the part matching the top-level
+// benchmarks and the rest, including the leading slash. Like the testing
+// package, slashes within brackets or parentheses don't split.
+func splitBench(bench string) (string, string) {
+	depth := 0
+	for i := 0; i < len(bench); i++ {
+		switch bench[i] {
+		case '\\':
+			i++
+		case '[', '(':
+			depth++
+		case ']', ')':
+			depth--
+		case '/':
+			if depth == 0 {
+				return bench[:i], bench[i:]
+			}
+		}
+	}
+	return bench, ""
+}
+
+// restrictBench returns a -test.bench regexp matching exactly the top-level
+// benchmarks names, followed by rest for the sub-benchmarks. It returns an
+// empty string if there's no name.
+func restrictBench(names []string, rest string) string {
+	if len(names) == 0 {
+		return ""
+	}
+	q := make([]string, len(names))
+	for i, n := range names {
+		q[i] = regexp.QuoteMeta(n)
+	}
+	return "^Benchmark(?:" + strings.Join(q, "|") + ")$" + rest
+}
+
+// pairRenames reports each removed benchmark with a similar name to an added
+// one as renamed to it. It returns the removed benchmarks followed by the
+// added ones left.
+func pairRenames(removed, added []benchDiff) []benchDiff {
+	out := make([]benchDiff, 0, len(removed)+len(added))
+	for _, r := range removed {
+		best, score := -1, 0.
+		for i, a := range added {
+			if s := similarity(r.Benchmark, a.Benchmark); s >= 0.5 && s > score {
+				best, score = i, s
+			}
+		}
+		if best != -1 {
+			r.Change = "renamed"
+			r.To = added[best].Benchmark
+			added = append(added[:best:best], added[best+1:]...)
+		}
+		out = append(out, r)
+	}
+	return append(out, added...)
+}
+
+// similarity returns the ratio of the longest name covered by the common
+// prefix and suffix of both names, between 0 and 1.
+func similarity(a, b string) float64 {
+	n := len(a)
+	if len(b) > n {
+		n = len(b)
+	}
+	if n == 0 {
+		return 1
+	}
+	p := 0
+	for p < len(a) && p < len(b) && a[p] == b[p] {
+		p++
+	}
+	s := 0
+	for s < len(a)-p && s < len(b)-p && a[len(a)-1-s] == b[len(b)-1-s] {
+		s++
+	}
+	return float64(p+s) / float64(n)
+}
+
+// printUnmatched writes the benchmarks not compared as text.
+func printUnmatched(w io.Writer, diffs []benchDiff) error {
+	if len(diffs) == 0 {
+		return nil
+	}
+	if _, err := fmt.Fprintf(w, "\nNot compared:\n"); err != nil {
+		return err
+	}
+	for i := range diffs {
+		if _, err := fmt.Fprintf(w, "  %s\n", diffs[i].String()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// markdownUnmatched writes the benchmarks not compared as a Markdown list.
+func markdownUnmatched(w io.Writer, diffs []benchDiff) error {
+	if len(diffs) == 0 {
+		return nil
+	}
+	if _, err := fmt.Fprintf(w, "\n### Not compared\n\n"); err != nil {
+		return err
+	}
+	for i := range diffs {
+		if _, err := fmt.Fprintf(w, "- %s\n", markdownEscaper.Replace(diffs[i].String())); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,149 @@
+// Copyright 2022 Marc-Antoine Ruel. All rights reserved.
+// Use of this source code is governed under the Apache License, Version 2.0
+// that can be found in the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func TestSplitBench(t *testing.T) {
+	data := []struct {
+		in, top, rest string
+	}{
+		{".", ".", ""},
+		{"Foo/size=4k", "Foo", "/size=4k"},
+		{"Foo/a/b", "Foo", "/a/b"},
+		{"(A/B)|C/x", "(A/B)|C", "/x"},
+		{"[/]x/y", "[/]x", "/y"},
+		{`a\/b/c`, `a\/b`, "/c"},
+	}
+	for i, l := range data {
+		if top, rest := splitBench(l.in); top != l.top || rest != l.rest {
+			t.Errorf("#%d: %q, %q", i, top, rest)
+		}
+	}
+}
+
+func TestRestrictBench(t *testing.T) {
+	if got := restrictBench(nil, ""); got != "" {
+		t.Fatal(got)
+	}
+	got := restrictBench([]string{"Foo", "Bar.Baz"}, "/x")
+	if got != `^Benchmark(?:Foo|Bar\.Baz)$/x` {
+		t.Fatal(got)
+	}
+	top, _ := splitBench(got)
+	re := regexp.MustCompile(top)
+	for name, want := range map[string]bool{"BenchmarkFoo": true, "BenchmarkBar.Baz": true, "BenchmarkBarxBaz": false, "BenchmarkFoo2": false} {
+		if re.MatchString(name) != want {
+			t.Errorf("%s: expected %t", name, want)
+		}
+	}
+}
+
+func TestPairRenames(t *testing.T) {
+	removed := []benchDiff{
+		{Package: "p", Benchmark: "Parse", Change: "removed"},
+		{Package: "p", Benchmark: "Gone", Change: "removed"},
+	}
+	added := []benchDiff{
+		{Package: "p", Benchmark: "New", Change: "added"},
+		{Package: "p", Benchmark: "ParseFast", Change: "added"},
+	}
+	var got []string
+	for _, d := range pairRenames(removed, added) {
+		got = append(got, d.String())
+	}
+	want := "p: Parse renamed to ParseFast\np: Gone removed\np: New added"
+	if s := strings.Join(got, "\n"); s != want {
+		t.Fatal(s)
+	}
+	if len(added) != 2 || added[1].Benchmark != "ParseFast" {
+		t.Fatal("added was modified")
+	}
+}
+
+func TestBenchDiffString(t *testing.T) {
+	data := []struct {
+		d    benchDiff
+		want string
+	}{
+		{benchDiff{Package: "p", Benchmark: "A", Change: "missing", Sides: []string{"HEAD~1", "HEAD~2"}}, "p: A missing on HEAD~1, HEAD~2"},
+		{benchDiff{Package: "p", Benchmark: "A", Metric: "B/op", Change: "missing", Sides: []string{"HEAD~1"}}, "p: A B/op missing on HEAD~1"},
+		{benchDiff{Package: "p", Change: "broken", Sides: []string{"HEAD~1"}}, "p: failed to build on HEAD~1"},
+	}
+	for i, l := range data {
+		if got := l.d.String(); got != l.want {
+			t.Errorf("#%d: %q", i, got)
+		}
+	}
+}
+
+func TestPartialRows(t *testing.T) {
+	old := ""
+	new := ""
+	for i := 0; i < 4; i++ {
+		old += fmt.Sprintf("BenchmarkFoo/size=1k \t100\t%d ns/op\nBenchmarkFoo/size=4k \t100\t%d ns/op\n", 1000+i, 4000+i)
+		new += fmt.Sprintf("BenchmarkFoo/size=1k \t100\t%d ns/op\nBenchmarkFoo/size=1M \t100\t%d ns/op\n", 1000+i, 900000+i)
+	}
+	a := newAnalysis()
+	a.geomean = true
+	tables, err := a.genBenchTables([]string{"HEAD~1", "HEAD"}, []string{"pkg: p\n" + old, "pkg: p\n" + new})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tables, diffs := partialRows(tables)
+	if len(tables) != 1 {
+		t.Fatalf("got %d tables", len(tables))
+	}
+	var got []string
+	for _, r := range tables[0].rows {
+		got = append(got, r.benchmark)
+	}
+	if s := strings.Join(got, ","); s != "Foo/size=1k" {
+		t.Fatal(s)
+	}
+	got = nil
+	for i := range diffs {
+		got = append(got, diffs[i].String())
+	}
+	if s := strings.Join(got, "\n"); s != "p: Foo/size=1M added\np: Foo/size=4k removed" {
+		t.Fatal(s)
+	}
+
+	// Without a partial row, the tables are left as-is.
+	if tables2, diffs2 := partialRows(tables); len(diffs2) != 0 || tables2[0] != tables[0] {
+		t.Fatal("unexpected change")
+	}
+}
+
+func TestPartialRowsMetric(t *testing.T) {
+	// Only HEAD runs with -benchmem.
+	old := ""
+	new := ""
+	for i := 0; i < 4; i++ {
+		old += fmt.Sprintf("BenchmarkFoo \t100\t%d ns/op\n", 1000+i)
+		new += fmt.Sprintf("BenchmarkFoo \t100\t%d ns/op\t16 B/op\t1 allocs/op\n", 1000+i)
+	}
+	a := newAnalysis()
+	tables, err := a.genBenchTables([]string{"HEAD~1", "HEAD"}, []string{"pkg: p\n" + old, "pkg: p\n" + new})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tables, diffs := partialRows(tables)
+	if len(tables) != 1 || tables[0].metric != "sec/op" {
+		t.Fatalf("got %d tables", len(tables))
+	}
+	var got []string
+	for i := range diffs {
+		got = append(got, diffs[i].String())
+	}
+	if s := strings.Join(got, "\n"); s != "p: Foo B/op missing on HEAD~1\np: Foo allocs/op missing on HEAD~1" {
+		t.Fatal(s)
+	}
+}
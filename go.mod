@@ -7,10 +7,7 @@ require (
 	github.com/mattn/go-isatty v0.0.19
 	github.com/mgutz/ansi v0.0.0-20200706080929-d51e80ef957d
 	golang.org/x/perf v0.0.0-20230427221525-d343f6398b76
+	golang.org/x/sys v0.8.0
 )
 
-require (
-	github.com/google/safehtml v0.1.0 // indirect
-	golang.org/x/sys v0.8.0 // indirect
-	golang.org/x/text v0.9.0 // indirect
-)
+require github.com/aclements/go-moremath v0.0.0-20210112150236-f10218a38794 // indirect